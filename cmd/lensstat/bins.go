@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// StandardPrimes are the usual focal lengths of prime lenses, in mm,
+// for -snap.
+const standardPrimes = "14,20,24,28,35,50,85,105,135,200,300,400,600"
+
+// Bins says how focal lengths are bucketed in a distribution. By
+// default each millimeter gets its own bin.
+type bins struct {
+	width     int       // bin width in mm
+	perOctave int       // logarithmic bins per doubling, if not 0
+	snap      []float64 // snap to the nearest of these, if not nil
+	min, max  float64   // range, 0 if unbounded
+}
+
+// ParsePrimes parses the comma separated list of focal lengths s.
+func parsePrimes(s string) ([]float64, error) {
+	var primes []float64
+	for _, f := range strings.Split(s, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil || v <= 0 {
+			return nil, errors.New("bad focal length " + strconv.Quote(f))
+		}
+		primes = append(primes, v)
+	}
+	sort.Float64s(primes)
+	return primes, nil
+}
+
+// Bin returns the key of the bin of focal length f. Keys grow with
+// the focal lengths of their bins; value gives what they stand for.
+func (b *bins) bin(f float64) int {
+	switch {
+	case b.snap != nil:
+		// Nearest by ratio, so that 70mm goes to 85mm rather than 50mm.
+		best := 0
+		for i, s := range b.snap[1:] {
+			if math.Abs(math.Log(f/s)) < math.Abs(math.Log(f/b.snap[best])) {
+				best = i + 1
+			}
+		}
+		return best
+	case b.perOctave > 0:
+		return int(math.Floor(float64(b.perOctave) * math.Log2(f)))
+	}
+	r := int(math.Round(f))
+	return r / b.width * b.width
+}
+
+// Value returns the value bin k is labeled with: its lower bound in
+// mm, or the prime it snaps to. Logarithmic bounds are rounded to as
+// many decimals as it takes to tell them from the next one.
+func (b *bins) value(k int) float64 {
+	switch {
+	case b.snap != nil:
+		return b.snap[k]
+	case b.perOctave > 0:
+		n := float64(b.perOctave)
+		lo, v, hi := math.Exp2(float64(k-1)/n), math.Exp2(float64(k)/n), math.Exp2(float64(k+1)/n)
+		scale := 1.0
+		for i := 0; i < 6; i++ {
+			r := math.Round(v*scale) / scale
+			if r != math.Round(lo*scale)/scale && r != math.Round(hi*scale)/scale {
+				break
+			}
+			scale *= 10
+		}
+		return math.Round(v*scale) / scale
+	}
+	return float64(k)
+}
+
+// BinLabel returns the label of bin k.
+func (b *bins) binLabel(k int) string {
+	return strconv.FormatFloat(b.value(k), 'f', -1, 64)
+}
+
+// InRange reports whether f is below, in, or above the range of b,
+// as -1, 0, or 1.
+func (b *bins) inRange(f float64) int {
+	switch {
+	case b.min > 0 && f < b.min:
+		return -1
+	case b.max > 0 && f > b.max:
+		return 1
+	}
+	return 0
+}
+
+// Percentile returns the p-th percentile of the sorted values, by the
+// nearest-rank method.
+func percentile(values []float64, p float64) float64 {
+	i := int(math.Ceil(p/100*float64(len(values)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return values[i]
+}
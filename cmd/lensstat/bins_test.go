@@ -0,0 +1,54 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestBins(t *testing.T) {
+	primes, err := parsePrimes(standardPrimes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		b     bins
+		f     float64
+		label string
+	}{
+		{bins{width: 1}, 49.6, "50"},
+		{bins{width: 10}, 57, "50"},
+		{bins{width: 10}, 49.6, "50"},
+		{bins{perOctave: 1}, 50, "32"},
+		{bins{perOctave: 3}, 50, "40"},
+		{bins{perOctave: 24}, 14.1, "13.8"},
+		{bins{perOctave: 24}, 50, "49"},
+		{bins{perOctave: 24}, 14.5, "14.3"},
+		{bins{snap: primes}, 70, "85"},
+		{bins{snap: primes}, 60, "50"},
+		{bins{snap: []float64{1.4, 2, 2.8}}, 1.5, "1.4"},
+	}
+	for _, tt := range tests {
+		if got := tt.b.binLabel(tt.b.bin(tt.f)); got != tt.label {
+			t.Errorf("%+v: bin of %g labeled %q, want %q", tt.b, tt.f, got, tt.label)
+		}
+	}
+}
+
+// TestLogBinLabels checks that logarithmic bins with narrow steps
+// neither collide nor get labels out of order.
+func TestLogBinLabels(t *testing.T) {
+	for _, n := range []int{1, 3, 12, 24, 100} {
+		b := bins{perOctave: n}
+		prev, seen := math.Inf(-1), make(map[string]bool)
+		for k := b.bin(1); k <= b.bin(1200); k++ {
+			v, l := b.value(k), b.binLabel(k)
+			if seen[l] {
+				t.Errorf("-log %d: label %s used twice", n, l)
+			}
+			if v <= prev {
+				t.Errorf("-log %d: bin %d at %g after %g", n, k, v, prev)
+			}
+			seen[l], prev = true, v
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Chart geometry, in pixels.
+const (
+	charW  = 8  // advance of a character
+	charH  = 10 // height of a line of text
+	barW   = 16 // width of a bar
+	plotH  = 300
+	margin = 16
+	minW   = 240 // width of the plot, at least
+)
+
+// Palette gives the colours of the groups, in turn.
+var palette = []color.RGBA{
+	{0x4e, 0x79, 0xa7, 0xff},
+	{0xf2, 0x8e, 0x2b, 0xff},
+	{0xe1, 0x57, 0x59, 0xff},
+	{0x76, 0xb7, 0xb2, 0xff},
+	{0x59, 0xa1, 0x4f, 0xff},
+	{0xed, 0xc9, 0x48, 0xff},
+	{0xb0, 0x7a, 0xa1, 0xff},
+	{0xff, 0x9d, 0xa7, 0xff},
+	{0x9c, 0x75, 0x5f, 0xff},
+	{0xba, 0xb0, 0xac, 0xff},
+}
+
+var (
+	black = color.RGBA{0, 0, 0, 0xff}
+	grey  = color.RGBA{0xdd, 0xdd, 0xdd, 0xff}
+	white = color.RGBA{0xff, 0xff, 0xff, 0xff}
+)
+
+// A canvas is something to draw a chart on.
+type canvas interface {
+	rect(x, y, w, h int, c color.RGBA)
+	// Text draws s with its top at y, starting, centered on, or
+	// ending at x, as align is -1, 0, or 1.
+	text(x, y int, s string, align int)
+	io.WriterTo
+}
+
+// ChartFormat returns the format of chart file name, svg or png, by
+// its extension.
+func chartFormat(name string) (string, error) {
+	switch ext := strings.ToLower(filepath.Ext(name)); ext {
+	case ".svg", ".png":
+		return ext[1:], nil
+	}
+	return "", fmt.Errorf("%s: unknown chart format, want .svg or .png", name)
+}
+
+// WriteChart draws the distributions of the groups as a bar chart in
+// the SVG or PNG file name, one colour per group. The groups are
+// named only with -by, which is by.
+func writeChart(name string, groups []photoGroup, b *bins, by string) error {
+	format, err := chartFormat(name)
+	if err != nil {
+		return err
+	}
+
+	// The rows of all the groups, and their counts in each.
+	counts := make([]map[string]int, len(groups))
+	var labels []string
+	have := make(map[string]bool)
+	max := 0
+	for i, g := range groups {
+		counts[i] = make(map[string]int)
+		for _, r := range focals(g.photos, b).rows(b) {
+			if !have[r.label] {
+				have[r.label] = true
+				labels = append(labels, r.label)
+			}
+			counts[i][r.label] = r.n
+			if r.n > max {
+				max = r.n
+			}
+		}
+	}
+	sort.Slice(labels, func(i, j int) bool { return labelLess(labels[i], labels[j]) })
+	step, top := ticks(max)
+
+	// Layout.
+	slot := len(groups)*barW + 8
+	for _, l := range labels {
+		if w := len(l)*charW + 8; w > slot {
+			slot = w
+		}
+	}
+	left := margin + len(strconv.Itoa(top))*charW + 8
+	plotTop := margin + 2*(charH+12)
+	bottom := plotTop + plotH
+	if len(labels) > 0 && len(labels)*slot < minW {
+		slot = minW / len(labels)
+	}
+	plotW := len(labels) * slot
+	if plotW == 0 {
+		plotW = minW
+	}
+	title := "35mm-equivalent focal length distribution"
+	if by != "" {
+		title += " by " + by
+	}
+	width := left + plotW + margin
+	if w := left + len(title)*charW + margin; w > width {
+		width = w
+	}
+	height := bottom + 2*(charH+10) + margin
+	legend := groups[0].kind != ""
+	legendX := left + plotW + 24
+	if legend {
+		nameW := 0
+		for _, g := range groups {
+			if w := len(legendName(g, by)) * charW; w > nameW {
+				nameW = w
+			}
+		}
+		if w := legendX + 16 + nameW + margin; w > width {
+			width = w
+		}
+		if h := plotTop + len(groups)*(charH+8) + margin; h > height {
+			height = h
+		}
+	}
+
+	var c canvas
+	if format == "svg" {
+		c = newSVG(width, height)
+	} else {
+		c = newPNG(width, height)
+	}
+
+	c.text(left, margin, title, -1)
+	c.text(margin, plotTop-charH-12, "photos", -1)
+	for v := 0; v <= top; v += step {
+		y := bottom - v*plotH/top
+		c.rect(left, y, plotW, 1, grey)
+		c.text(left-8, y-charH/2, strconv.Itoa(v), 1)
+	}
+	for i, l := range labels {
+		x := left + i*slot + (slot-len(groups)*barW)/2
+		for j := range groups {
+			h := counts[j][l] * plotH / top
+			if h == 0 {
+				continue
+			}
+			c.rect(x+j*barW, bottom-h, barW-2, h, palette[j%len(palette)])
+		}
+		c.text(left+i*slot+slot/2, bottom+6, l, 0)
+	}
+	c.rect(left, plotTop, 1, plotH+1, black)
+	c.rect(left, bottom, plotW, 1, black)
+	c.text(left+plotW/2, bottom+6+charH+10, "focal length (mm)", 0)
+	if legend {
+		for j, g := range groups {
+			y := plotTop + j*(charH+8)
+			c.rect(legendX, y, charH, charH, palette[j%len(palette)])
+			c.text(legendX+16, y, legendName(g, by), -1)
+		}
+	}
+
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if _, err := c.WriteTo(w); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// LabelLess orders row labels like rows: below the range, the bins,
+// above the range, and unknown.
+func labelLess(a, b string) bool {
+	rank := func(l string) (int, float64) {
+		switch l[0] {
+		case '<':
+			return 0, 0
+		case '>':
+			return 2, 0
+		case '?':
+			return 3, 0
+		}
+		f, _ := strconv.ParseFloat(l, 64)
+		return 1, f
+	}
+	ra, na := rank(a)
+	rb, nb := rank(b)
+	if ra != rb {
+		return ra < rb
+	}
+	return na < nb
+}
+
+func legendName(g photoGroup, by string) string {
+	if g.kind == kindUnknown {
+		return fmt.Sprintf("unknown %s (%d)", by, len(g.photos))
+	}
+	return fmt.Sprintf("%s (%d)", g.name, len(g.photos))
+}
+
+// Ticks returns the step of the ticks of an axis up to max, 1, 2, or
+// 5 times a power of ten, and the last tick.
+func ticks(max int) (step, top int) {
+	if max < 1 {
+		return 1, 1
+	}
+	pow := int(math.Pow(10, math.Floor(math.Log10(float64(max)/5))))
+	if pow < 1 {
+		pow = 1
+	}
+	for _, m := range []int{1, 2, 5, 10} {
+		step = m * pow
+		if max/step <= 5 {
+			break
+		}
+	}
+	top = (max + step - 1) / step * step
+	return step, top
+}
+
+// An svg is a canvas writing SVG.
+type svg struct {
+	w, h int
+	b    strings.Builder
+}
+
+func newSVG(w, h int) *svg {
+	s := &svg{w: w, h: h}
+	s.rect(0, 0, w, h, white)
+	return s
+}
+
+func (s *svg) rect(x, y, w, h int, c color.RGBA) {
+	fmt.Fprintf(&s.b, "<rect x=\"%d\" y=\"%d\" width=\"%d\" height=\"%d\" fill=\"#%02x%02x%02x\"/>\n", x, y, w, h, c.R, c.G, c.B)
+}
+
+func (s *svg) text(x, y int, str string, align int) {
+	anchor := [...]string{"start", "middle", "end"}[align+1]
+	fmt.Fprintf(&s.b, "<text x=\"%d\" y=\"%d\" text-anchor=\"%s\">", x, y+charH, anchor)
+	xml.EscapeText(&s.b, []byte(str))
+	s.b.WriteString("</text>\n")
+}
+
+func (s *svg) WriteTo(w io.Writer) (int64, error) {
+	n, err := fmt.Fprintf(w, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\" viewBox=\"0 0 %d %d\" font-family=\"monospace\" font-size=\"13\">\n%s</svg>\n",
+		s.w, s.h, s.w, s.h, s.b.String())
+	return int64(n), err
+}
+
+// A pngCanvas is a canvas drawing a PNG image, with the text in the
+// 3x5 font scaled twice.
+type pngCanvas struct {
+	img *image.RGBA
+}
+
+func newPNG(w, h int) *pngCanvas {
+	p := &pngCanvas{image.NewRGBA(image.Rect(0, 0, w, h))}
+	draw.Draw(p.img, p.img.Bounds(), image.NewUniform(white), image.Point{}, draw.Src)
+	return p
+}
+
+func (p *pngCanvas) rect(x, y, w, h int, c color.RGBA) {
+	draw.Draw(p.img, image.Rect(x, y, x+w, y+h), image.NewUniform(c), image.Point{}, draw.Src)
+}
+
+func (p *pngCanvas) text(x, y int, s string, align int) {
+	runes := []rune(s)
+	w := len(runes)*charW - 2
+	x -= (align + 1) * w / 2
+	for i, r := range runes {
+		for gy, row := range glyph(r) {
+			for gx, px := range row {
+				if px == '#' {
+					p.rect(x+i*charW+2*gx, y+2*gy, 2, 2, black)
+				}
+			}
+		}
+	}
+}
+
+func (p *pngCanvas) WriteTo(w io.Writer) (int64, error) {
+	return 0, png.Encode(w, p.img)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestTicks(t *testing.T) {
+	tests := []struct {
+		max, step, top int
+	}{
+		{0, 1, 1},
+		{1, 1, 1},
+		{7, 2, 8},
+		{23, 5, 25},
+		{1000, 200, 1000},
+	}
+	for _, tt := range tests {
+		if step, top := ticks(tt.max); step != tt.step || top != tt.top {
+			t.Errorf("ticks(%d) = %d, %d, want %d, %d", tt.max, step, top, tt.step, tt.top)
+		}
+	}
+}
+
+func TestLabelLess(t *testing.T) {
+	want := []string{"<28", "8", "13.8", "16", "35", "100", ">200", "?"}
+	got := []string{"?", "100", ">200", "16", "<28", "35", "13.8", "8"}
+	sort.Slice(got, func(i, j int) bool { return labelLess(got[i], got[j]) })
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("sorted labels %q, want %q", got, want)
+	}
+}
+
+// Bars returns the number of bars in the SVG chart r, and fails if it
+// isn't well-formed XML.
+func bars(t *testing.T, r io.Reader) int {
+	t.Helper()
+	fills := make(map[string]bool)
+	for _, c := range palette {
+		fills[fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)] = true
+	}
+	n := 0
+	d := xml.NewDecoder(r)
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("chart isn't XML: %v", err)
+		}
+		e, ok := tok.(xml.StartElement)
+		if !ok || e.Name.Local != "rect" {
+			continue
+		}
+		var fill, width string
+		for _, a := range e.Attr {
+			switch a.Name.Local {
+			case "fill":
+				fill = a.Value
+			case "width":
+				width = a.Value
+			}
+		}
+		// Legend keys are squares of a different width.
+		if fills[fill] && width == fmt.Sprint(barW-2) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestWriteChart(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name   string
+		groups []photoGroup
+		bars   int
+	}{
+		{"all", []photoGroup{{photos: testPhotos}}, 5},
+		{"by camera", group(testPhotos, groupKeys["camera"]), 5},
+		{"by year", group(testPhotos, groupKeys["year"]), 5},
+		{"empty", []photoGroup{{}}, 0},
+	}
+	for _, tt := range tests {
+		name := filepath.Join(dir, tt.name+".svg")
+		if err := writeChart(name, tt.groups, testBins, "camera"); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := bars(t, f); n != tt.bars {
+			t.Errorf("%s: %d bars, want %d", tt.name, n, tt.bars)
+		}
+		f.Close()
+	}
+
+	name := filepath.Join(dir, "chart.png")
+	if err := writeChart(name, []photoGroup{{photos: testPhotos}}, testBins, ""); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := png.Decode(f); err != nil {
+		t.Errorf("chart isn't PNG: %v", err)
+	}
+}
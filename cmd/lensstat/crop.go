@@ -0,0 +1,107 @@
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+// CropFactors maps cameras to the crop factor of their sensor, for
+// the photos that don't record their 35mm-equivalent focal length.
+// The patterns are matched against the lower case camera name, as
+// returned by camera, and the first match wins.
+var cropFactors = []struct {
+	pattern string
+	factor  float64
+}{
+	// Canon: full frame, then APS-C. The R models are spelled out,
+	// as r5 and r50 differ only by a digit: r6m2 is the R6 Mark II,
+	// r5 c the cinema R5.
+	{"canon eos r", 1},
+	{"canon eos rp", 1},
+	{"canon eos r[13568]", 1},
+	{"canon eos r[3568] *", 1},
+	{"canon eos r[3568]m*", 1},
+	{"canon eos r[3568]c", 1},
+	{"canon eos [56]d*", 1},
+	{"canon eos-1d*", 1},
+	{"canon eos r7", 1.6},
+	{"canon eos r10", 1.6},
+	{"canon eos r50", 1.6},
+	{"canon eos r100", 1.6},
+	{"canon eos [0-9]*d*", 1.6},
+	{"canon eos m*", 1.6},
+	{"canon eos rebel*", 1.6},
+	{"canon eos kiss*", 1.6},
+	{"canon powershot g1 x mark iii", 1.6},
+	{"canon powershot g1 x*", 1.85},
+	{"canon powershot g[579] x*", 2.7},
+
+	// Nikon: DX, then FX.
+	{"nikon d[3-7][0-9][0-9][0-9]", 1.5},
+	{"nikon d[1-5]00", 1.5},
+	{"nikon d[1-9]0", 1.5},
+	{"nikon z 50*", 1.5},
+	{"nikon z 30", 1.5},
+	{"nikon z fc", 1.5},
+	{"nikon d[6-8][0-9]0*", 1},
+	{"nikon d[3-6]*", 1},
+	{"nikon df", 1},
+	{"nikon z*", 1},
+
+	// Sony: full frame, then APS-C and 1".
+	{"sony ilce-[179]*", 1},
+	{"sony ilca-99*", 1},
+	{"sony zv-e1", 1},
+	{"sony ilce-[3-6]*", 1.5},
+	{"sony ilca-*", 1.5},
+	{"sony nex-*", 1.5},
+	{"sony zv-e10*", 1.5},
+	{"sony dsc-rx1", 1},
+	{"sony dsc-rx1r*", 1},
+	{"sony dsc-rx10*", 2.7},
+	{"sony dsc-rx100*", 2.7},
+	{"sony zv-1*", 2.7},
+
+	{"fujifilm gfx*", 0.79},
+	{"fujifilm x*", 1.5},
+
+	// Camera names keep the maker when the model doesn't repeat it,
+	// as with OM System and the Pentax models of Ricoh.
+	{"olympus *", 2},
+	{"om-*", 2},
+	{"om digital solutions *", 2},
+	{"panasonic dc-s*", 1},
+	{"panasonic dc-g*", 2},
+	{"panasonic dmc-g*", 2},
+
+	{"pentax k-1*", 1},
+	{"pentax k*", 1.5},
+	{"ricoh imaging company, ltd. pentax k-1*", 1},
+	{"ricoh imaging company, ltd. pentax k*", 1.5},
+	{"ricoh*gr*", 1.5},
+
+	{"leica m*", 1},
+	{"leica q*", 1},
+	{"leica sl*", 1},
+}
+
+// CropFactor returns the crop factor of camera, or 0 if it's unknown.
+func cropFactor(camera string) float64 {
+	camera = strings.ToLower(camera)
+	for _, c := range cropFactors {
+		if ok, _ := path.Match(c.pattern, camera); ok {
+			return c.factor
+		}
+	}
+	return 0
+}
+
+// Equivalent returns the 35mm-equivalent focal length of p, computed
+// from its actual focal length and the crop factor of its camera if
+// it's not recorded, or 0 if it's unknown.
+func equivalent(p *photo) float64 {
+	if p.focal35 != 0 {
+		return p.focal35
+	}
+	return p.focal * cropFactor(p.camera)
+}
@@ -0,0 +1,68 @@
+package main
+
+import "testing"
+
+func TestCropFactor(t *testing.T) {
+	tests := []struct {
+		maker, model string
+		factor       float64
+	}{
+		{"Canon", "Canon EOS R", 1},
+		{"Canon", "Canon EOS RP", 1},
+		{"Canon", "Canon EOS R1", 1},
+		{"Canon", "Canon EOS R3", 1},
+		{"Canon", "Canon EOS R5", 1},
+		{"Canon", "Canon EOS R5 C", 1},
+		{"Canon", "Canon EOS R6", 1},
+		{"Canon", "Canon EOS R6m2", 1},
+		{"Canon", "Canon EOS R8", 1},
+		{"Canon", "Canon EOS R7", 1.6},
+		{"Canon", "Canon EOS R10", 1.6},
+		{"Canon", "Canon EOS R50", 1.6},
+		{"Canon", "Canon EOS R100", 1.6},
+		{"Canon", "Canon EOS 5D Mark IV", 1},
+		{"Canon", "Canon EOS 6D", 1},
+		{"Canon", "Canon EOS-1D X Mark III", 1},
+		{"Canon", "Canon EOS 50D", 1.6},
+		{"Canon", "Canon EOS 7D Mark II", 1.6},
+		{"Canon", "Canon EOS M50", 1.6},
+		{"Canon", "Canon EOS Rebel T7i", 1.6},
+		{"Canon", "Canon PowerShot G1 X", 1.85},
+		{"Canon", "Canon PowerShot G1 X Mark II", 1.85},
+		{"Canon", "Canon PowerShot G1 X Mark III", 1.6},
+		{"Canon", "Canon PowerShot G5 X Mark II", 2.7},
+		{"Canon", "Canon PowerShot G7 X Mark III", 2.7},
+		{"Canon", "Canon PowerShot G9 X", 2.7},
+		{"Canon", "Canon PowerShot G12", 0},
+		{"NIKON CORPORATION", "NIKON D850", 1},
+		{"NIKON CORPORATION", "NIKON D7500", 1.5},
+		{"NIKON CORPORATION", "NIKON D3", 1},
+		{"NIKON CORPORATION", "NIKON Z 6_2", 1},
+		{"NIKON CORPORATION", "NIKON Z 50", 1.5},
+		{"SONY", "ILCE-7M3", 1},
+		{"SONY", "ILCE-6400", 1.5},
+		{"SONY", "DSC-RX100M7", 2.7},
+		{"FUJIFILM", "X-T4", 1.5},
+		{"FUJIFILM", "GFX100S", 0.79},
+		{"OLYMPUS CORPORATION", "E-M1MarkII", 2},
+		{"OM Digital Solutions", "OM-1", 2},
+		{"OM Digital Solutions", "OM-5", 2},
+		{"OM Digital Solutions", "E-M10MarkIV", 2},
+		{"Panasonic", "DC-G9", 2},
+		{"Panasonic", "DC-S5", 1},
+		{"PENTAX", "PENTAX K-1", 1},
+		{"PENTAX", "PENTAX K-5", 1.5},
+		{"RICOH IMAGING COMPANY, LTD.", "PENTAX K-1 Mark II", 1},
+		{"RICOH IMAGING COMPANY, LTD.", "PENTAX K-3 Mark III", 1.5},
+		{"RICOH IMAGING COMPANY, LTD.", "GR III", 1.5},
+		{"LEICA CAMERA AG", "LEICA Q2", 1},
+		{"Apple", "iPhone 13", 0},
+		{"", "", 0},
+	}
+	for _, tt := range tests {
+		name := camera(tt.maker, tt.model)
+		if got := cropFactor(name); got != tt.factor {
+			t.Errorf("cropFactor(%q) = %g, want %g", name, got, tt.factor)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// TIFF tags we look for.
+const (
+	tagMake       = 0x010f
+	tagModel      = 0x0110
+	tagExifIFD    = 0x8769
+	tagFocal      = 0x920a
+	tagFocal35    = 0xa405
+	tagLensModel  = 0xa434
+	tagDateTime   = 0x0132
+	tagDateTimeOr = 0x9003
+)
+
+// MaxEntries bounds the size of the IFDs we read, as a defense
+// against garbage.
+const maxEntries = 1024
+
+// ErrNoExif is returned for JPEG files without EXIF data.
+var errNoExif = errors.New("no EXIF data")
+
+// ReadExif reads the EXIF data of the named JPEG, TIFF, or TIFF-based
+// raw file, like DNG, CR2, NEF, ARW, or of the preview embedded in a
+// Fujifilm RAF file. A JPEG file without EXIF data gives an empty
+// photo.
+func readExif(name string) (*photo, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	p, err := exif(f)
+	if err == errNoExif {
+		// Not a failure: the photo is counted as unknown.
+		p, err = new(photo), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	p.file = name
+	return p, nil
+}
+
+// Exif reads the EXIF data of the file r.
+func exif(r io.ReaderAt) (*photo, error) {
+	var magic [16]byte
+	if _, err := r.ReadAt(magic[:], 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	switch {
+	case magic[0] == 0xff && magic[1] == 0xd8:
+		return jpegExif(r, 0)
+	case string(magic[:]) == "FUJIFILMCCD-RAW ":
+		// The header points to a JPEG preview with the EXIF data.
+		var b [4]byte
+		if _, err := r.ReadAt(b[:], 84); err != nil {
+			return nil, err
+		}
+		off := int64(binary.BigEndian.Uint32(b[:]))
+		if _, err := r.ReadAt(b[:2], off); err != nil || b[0] != 0xff || b[1] != 0xd8 {
+			return nil, errors.New("bad RAF preview")
+		}
+		return jpegExif(r, off)
+	case string(magic[:2]) == "II" || string(magic[:2]) == "MM":
+		return tiffExif(r, 0)
+	}
+	return nil, errors.New("unknown file format")
+}
+
+// JpegExif reads the EXIF data of the JPEG file at off in r, which is
+// in an APP1 segment.
+func jpegExif(r io.ReaderAt, off int64) (*photo, error) {
+	off += 2 // SOI
+	for {
+		var hdr [4]byte
+		if _, err := r.ReadAt(hdr[:], off); err != nil {
+			return nil, errNoExif
+		}
+		if hdr[0] != 0xff {
+			return nil, errors.New("bad JPEG segment")
+		}
+		marker := hdr[1]
+		if marker == 0xff { // fill byte
+			off++
+			continue
+		}
+		if marker == 0xda || marker == 0xd9 { // SOS, EOI
+			return nil, errNoExif
+		}
+		size := int64(binary.BigEndian.Uint16(hdr[2:]))
+		if size < 2 {
+			return nil, errors.New("bad JPEG segment")
+		}
+		if marker == 0xe1 {
+			var id [6]byte
+			if _, err := r.ReadAt(id[:], off+4); err == nil && string(id[:]) == "Exif\x00\x00" {
+				return tiffExif(r, off+10)
+			}
+		}
+		off += 2 + size
+	}
+}
+
+// A tiff reads the IFDs of TIFF data.
+type tiff struct {
+	r     io.ReaderAt
+	base  int64 // offset of the TIFF header in r
+	order binary.ByteOrder
+}
+
+// An entry is an IFD entry.
+type entry struct {
+	typ   uint16
+	count uint32
+	val   [4]byte // the value, or its offset if it doesn't fit
+}
+
+// TypeSize gives the size of the TIFF field types.
+var typeSize = map[uint16]int{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8, 13: 4,
+}
+
+// TiffExif reads the EXIF data of the TIFF data at base in r.
+func tiffExif(r io.ReaderAt, base int64) (*photo, error) {
+	var hdr [8]byte
+	if _, err := r.ReadAt(hdr[:], base); err != nil {
+		return nil, errors.New("short TIFF header")
+	}
+	t := &tiff{r: r, base: base}
+	switch string(hdr[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil, errors.New("bad TIFF header")
+	}
+	// 42 for TIFF, but ORF and RW2 use their own.
+	switch t.order.Uint16(hdr[2:]) {
+	case 42, 0x4f52, 0x5352, 0x55:
+	default:
+		return nil, errors.New("bad TIFF header")
+	}
+	ifd0, err := t.ifd(t.order.Uint32(hdr[4:]))
+	if err != nil {
+		return nil, err
+	}
+	p := &photo{
+		camera: camera(t.str(ifd0[tagMake]), t.str(ifd0[tagModel])),
+		date:   t.str(ifd0[tagDateTime]),
+	}
+	e, ok := ifd0[tagExifIFD]
+	if !ok {
+		return p, nil
+	}
+	off, ok := t.integer(e)
+	if !ok {
+		return p, nil
+	}
+	ifd, err := t.ifd(off)
+	if err != nil {
+		return nil, err
+	}
+	p.focal, _ = t.float(ifd[tagFocal])
+	p.focal35, _ = t.float(ifd[tagFocal35])
+	p.lens = t.str(ifd[tagLensModel])
+	if d := t.str(ifd[tagDateTimeOr]); d != "" {
+		p.date = d
+	}
+	return p, nil
+}
+
+// Ifd reads the IFD at off.
+func (t *tiff) ifd(off uint32) (map[uint16]entry, error) {
+	var b [2]byte
+	if _, err := t.r.ReadAt(b[:], t.base+int64(off)); err != nil {
+		return nil, fmt.Errorf("reading IFD: %v", err)
+	}
+	n := int(t.order.Uint16(b[:]))
+	if n > maxEntries {
+		return nil, errors.New("IFD too large")
+	}
+	buf := make([]byte, 12*n)
+	if _, err := t.r.ReadAt(buf, t.base+int64(off)+2); err != nil {
+		return nil, fmt.Errorf("reading IFD: %v", err)
+	}
+	ifd := make(map[uint16]entry, n)
+	for i := 0; i < n; i++ {
+		b := buf[12*i:]
+		var e entry
+		e.typ = t.order.Uint16(b[2:])
+		e.count = t.order.Uint32(b[4:])
+		copy(e.val[:], b[8:12])
+		ifd[t.order.Uint16(b)] = e
+	}
+	return ifd, nil
+}
+
+// Value returns the raw value of e.
+func (t *tiff) value(e entry) ([]byte, bool) {
+	size, ok := typeSize[e.typ]
+	if !ok || e.count == 0 || e.count > 1<<16 {
+		return nil, false
+	}
+	n := size * int(e.count)
+	if n <= 4 {
+		return e.val[:n], true
+	}
+	b := make([]byte, n)
+	if _, err := t.r.ReadAt(b, t.base+int64(t.order.Uint32(e.val[:]))); err != nil {
+		return nil, false
+	}
+	return b, true
+}
+
+// Str returns the value of the ASCII entry e, or "".
+func (t *tiff) str(e entry) string {
+	if e.typ != 2 {
+		return ""
+	}
+	b, ok := t.value(e)
+	if !ok {
+		return ""
+	}
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// Integer returns the first value of the integer entry e.
+func (t *tiff) integer(e entry) (uint32, bool) {
+	b, ok := t.value(e)
+	if !ok {
+		return 0, false
+	}
+	switch e.typ {
+	case 1, 7:
+		return uint32(b[0]), true
+	case 3:
+		return uint32(t.order.Uint16(b)), true
+	case 4, 13:
+		return t.order.Uint32(b), true
+	}
+	return 0, false
+}
+
+// Float returns the first value of the numeric entry e.
+func (t *tiff) float(e entry) (float64, bool) {
+	switch e.typ {
+	case 5, 10:
+		b, ok := t.value(e)
+		if !ok {
+			return 0, false
+		}
+		num, den := t.order.Uint32(b), t.order.Uint32(b[4:])
+		if den == 0 {
+			return 0, false
+		}
+		if e.typ == 10 {
+			return float64(int32(num)) / float64(int32(den)), true
+		}
+		return float64(num) / float64(den), true
+	}
+	v, ok := t.integer(e)
+	return float64(v), ok
+}
+
+// Camera returns the camera name made of the make and model, which
+// often repeats the make.
+func camera(maker, model string) string {
+	if maker == "" || model == "" {
+		return maker + model
+	}
+	first := strings.Fields(maker)[0]
+	if strings.HasPrefix(strings.ToLower(model), strings.ToLower(first)) {
+		return model
+	}
+	return maker + " " + model
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// A field is an IFD entry of a test file, with its value encoded.
+type field struct {
+	tag, typ uint16
+	count    uint32
+	data     []byte
+}
+
+func ascii(tag uint16, s string) field {
+	return field{tag, 2, uint32(len(s) + 1), append([]byte(s), 0)}
+}
+
+func short(order binary.ByteOrder, tag uint16, v uint16) field {
+	b := make([]byte, 2)
+	order.PutUint16(b, v)
+	return field{tag, 3, 1, b}
+}
+
+func long(order binary.ByteOrder, tag uint16, v uint32) field {
+	b := make([]byte, 4)
+	order.PutUint32(b, v)
+	return field{tag, 4, 1, b}
+}
+
+func rational(order binary.ByteOrder, tag uint16, num, den uint32) field {
+	b := make([]byte, 8)
+	order.PutUint32(b, num)
+	order.PutUint32(b[4:], den)
+	return field{tag, 5, 1, b}
+}
+
+// TiffData returns TIFF data in the given byte order with IFD0 made of
+// the fields ifd0, and, if exif isn't nil, an EXIF IFD made of exif.
+func tiffData(order binary.ByteOrder, ifd0, exif []field) []byte {
+	ifdSize := func(fields []field) int { return 2 + 12*len(fields) + 4 }
+	if exif != nil {
+		ifd0 = append(ifd0, long(order, tagExifIFD, 0))
+	}
+	exifOff := 8 + ifdSize(ifd0)
+	dataOff := exifOff
+	if exif != nil {
+		dataOff += ifdSize(exif)
+		ifd0[len(ifd0)-1].data = long(order, 0, uint32(exifOff)).data
+	}
+	var buf, data []byte
+	u16 := func(v uint16) {
+		var b [2]byte
+		order.PutUint16(b[:], v)
+		buf = append(buf, b[:]...)
+	}
+	u32 := func(v uint32) {
+		var b [4]byte
+		order.PutUint32(b[:], v)
+		buf = append(buf, b[:]...)
+	}
+	if order == binary.LittleEndian {
+		buf = append(buf, "II"...)
+	} else {
+		buf = append(buf, "MM"...)
+	}
+	u16(42)
+	u32(8)
+	put := func(fields []field) {
+		u16(uint16(len(fields)))
+		for _, f := range fields {
+			u16(f.tag)
+			u16(f.typ)
+			u32(f.count)
+			if len(f.data) <= 4 {
+				buf = append(buf, f.data...)
+				buf = append(buf, make([]byte, 4-len(f.data))...)
+				continue
+			}
+			u32(uint32(dataOff + len(data)))
+			data = append(data, f.data...)
+		}
+		u32(0) // no next IFD
+	}
+	put(ifd0)
+	if exif != nil {
+		put(exif)
+	}
+	return append(buf, data...)
+}
+
+// JpegData returns a JPEG file with a JFIF APP0 segment, and an EXIF
+// APP1 segment with tiff if it isn't nil.
+func jpegData(tiff []byte) []byte {
+	b := []byte{0xff, 0xd8}
+	b = append(b, 0xff, 0xe0, 0, 16)
+	b = append(b, "JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00"...)
+	if tiff != nil {
+		b = append(b, 0xff, 0xff) // fill bytes
+		b = append(b, 0xff, 0xe1)
+		b = append(b, byte((2+6+len(tiff))>>8), byte(2+6+len(tiff)))
+		b = append(b, "Exif\x00\x00"...)
+		b = append(b, tiff...)
+	}
+	b = append(b, 0xff, 0xda, 0, 2) // SOS
+	return append(b, 0xff, 0xd9)
+}
+
+// RafData returns a Fujifilm RAF file with the preview jpeg.
+func rafData(jpeg []byte) []byte {
+	b := make([]byte, 100)
+	copy(b, "FUJIFILMCCD-RAW 0201FF383501")
+	binary.BigEndian.PutUint32(b[84:], 100)
+	binary.BigEndian.PutUint32(b[88:], uint32(len(jpeg)))
+	return append(b, jpeg...)
+}
+
+// Fields returns the fields of a typical photo.
+func fields(order binary.ByteOrder) (ifd0, exif []field) {
+	ifd0 = []field{
+		ascii(tagMake, "Canon"),
+		ascii(tagModel, "Canon EOS R5"),
+		ascii(tagDateTime, "2023:05:01 10:00:00"),
+	}
+	exif = []field{
+		rational(order, tagFocal, 100, 2),
+		short(order, tagFocal35, 50),
+		ascii(tagLensModel, "RF50mm F1.8 STM"),
+		ascii(tagDateTimeOr, "2023:04:30 09:00:00"),
+	}
+	return ifd0, exif
+}
+
+var typical = photo{
+	focal35: 50,
+	focal:   50,
+	lens:    "RF50mm F1.8 STM",
+	camera:  "Canon EOS R5",
+	date:    "2023:04:30 09:00:00",
+}
+
+func TestExif(t *testing.T) {
+	le0, leExif := fields(binary.LittleEndian)
+	be0, beExif := fields(binary.BigEndian)
+	ii := tiffData(binary.LittleEndian, le0, leExif)
+	mm := tiffData(binary.BigEndian, be0, beExif)
+
+	noExifIFD := tiffData(binary.BigEndian, []field{
+		ascii(tagMake, "NIKON CORPORATION"),
+		ascii(tagModel, "NIKON D850"),
+		ascii(tagDateTime, "2019:01:02 03:04:05"),
+	}, nil)
+
+	// A long focal length, and a signed rational 35mm-equivalent one.
+	other := tiffData(binary.LittleEndian, []field{
+		ascii(tagMake, "FUJIFILM"),
+		ascii(tagModel, "X-T4"),
+	}, []field{
+		long(binary.LittleEndian, tagFocal, 23),
+		{tagFocal35, 10, 1, []byte{70, 0, 0, 0, 2, 0, 0, 0}},
+	})
+
+	// A zero denominator, and a string longer than anything read.
+	odd := tiffData(binary.LittleEndian, []field{
+		{tagMake, 2, 1<<16 + 1, []byte("Canon\x00")},
+		ascii(tagModel, "Canon EOS R5"),
+	}, []field{
+		rational(binary.LittleEndian, tagFocal, 50, 0),
+	})
+
+	// An IFD with too many entries.
+	huge := make([]byte, 10+12*(maxEntries+1))
+	copy(huge, "II\x2a\x00\x08\x00\x00\x00")
+	binary.LittleEndian.PutUint16(huge[8:], maxEntries+1)
+
+	tests := []struct {
+		name string
+		data []byte
+		want *photo // nil for an error
+	}{
+		{"tiff II", ii, &typical},
+		{"tiff MM", mm, &typical},
+		{"jpeg", jpegData(ii), &typical},
+		{"raf", rafData(jpegData(mm)), &typical},
+		{"no exif ifd", noExifIFD, &photo{camera: "NIKON D850", date: "2019:01:02 03:04:05"}},
+		{"long and srational", other, &photo{focal: 23, focal35: 35, camera: "FUJIFILM X-T4"}},
+		{"odd values", odd, &photo{camera: "Canon EOS R5"}},
+		{"ifd too large", huge, nil},
+		// Values that can't be read are unknown.
+		{"truncated values", ii[:len(ii)-40], &photo{focal35: 50, camera: "Canon EOS R5", date: "2023:05:01 10:00:00"}},
+		{"truncated ifd", ii[:20], nil},
+		{"truncated header", jpegData(ii[:4]), nil},
+		{"bad tiff magic", append([]byte("II\x2b\x00"), ii[4:]...), nil},
+		{"truncated raf", rafData(nil)[:90], nil},
+		{"raf without preview", rafData(nil), nil},
+		{"garbage", []byte("garbage, not a photo"), nil},
+		{"empty", nil, nil},
+	}
+	for _, tt := range tests {
+		p, err := exif(bytes.NewReader(tt.data))
+		switch {
+		case tt.want == nil && err == nil:
+			t.Errorf("%s: got %+v, want an error", tt.name, *p)
+		case tt.want == nil:
+		case err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case *p != *tt.want:
+			t.Errorf("%s: got %+v, want %+v", tt.name, *p, *tt.want)
+		}
+		if err == errNoExif {
+			t.Errorf("%s: a broken file taken for one without EXIF data", tt.name)
+		}
+	}
+}
+
+func TestNoExif(t *testing.T) {
+	for _, data := range [][]byte{
+		jpegData(nil),
+		jpegData(nil)[:20], // ends before any SOS
+		rafData(jpegData(nil)),
+	} {
+		if _, err := exif(bytes.NewReader(data)); err != errNoExif {
+			t.Errorf("exif(%q) = %v, want %v", data, err, errNoExif)
+		}
+	}
+}
+
+func TestCamera(t *testing.T) {
+	tests := []struct {
+		maker, model, want string
+	}{
+		{"Canon", "Canon EOS R5", "Canon EOS R5"},
+		{"NIKON CORPORATION", "NIKON D850", "NIKON D850"},
+		{"SONY", "ILCE-7M3", "SONY ILCE-7M3"},
+		{"OM Digital Solutions", "OM-1", "OM-1"},
+		{"OM Digital Solutions", "E-M10MarkIV", "OM Digital Solutions E-M10MarkIV"},
+		{"RICOH IMAGING COMPANY, LTD.", "PENTAX K-1", "RICOH IMAGING COMPANY, LTD. PENTAX K-1"},
+		{"Apple", "", "Apple"},
+		{"", "X100V", "X100V"},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		if got := camera(tt.maker, tt.model); got != tt.want {
+			t.Errorf("camera(%q, %q) = %q, want %q", tt.maker, tt.model, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// ExiftoolTags are the tags we ask exiftool(1) for.
+var exiftoolTags = []string{
+	"FocalLengthIn35mmFormat",
+	"FocalLength",
+	"LensModel",
+	"Make",
+	"Model",
+	"DateTimeOriginal",
+}
+
+// Exiftool reads the EXIF data of the named files with exiftool(1),
+// record by record. The names are passed on its standard input, as
+// there may be too many for the command line.
+func exiftool(names <-chan string) []*photo {
+	args := []string{"-q", "-n", "-csv", "-f"}
+	for _, tag := range exiftoolTags {
+		args = append(args, "-"+tag)
+	}
+	cmd := exec.Command("exiftool", append(args, "-@", "-")...)
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		log.Fatal(err)
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		log.Fatal(err)
+	}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		log.Fatal(err)
+	}
+	sent := make(chan int, 1)
+	go func() {
+		n := 0
+		w := bufio.NewWriter(in)
+		for name := range names {
+			fmt.Fprintln(w, name)
+			n++
+		}
+		w.Flush()
+		in.Close()
+		sent <- n
+	}()
+	r := csv.NewReader(out)
+	var photos []*photo
+	header, err := r.Read()
+	if err != nil && err != io.EOF {
+		log.Fatal(err)
+	}
+	col := make(map[string]int)
+	for i, name := range header {
+		col[name] = i
+	}
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		get := func(name string) string {
+			i, ok := col[name]
+			// -f prints missing tags as "-".
+			if !ok || rec[i] == "-" {
+				return ""
+			}
+			return rec[i]
+		}
+		p := &photo{
+			file:   get("SourceFile"),
+			lens:   get("LensModel"),
+			camera: camera(get("Make"), get("Model")),
+			date:   get("DateTimeOriginal"),
+		}
+		p.focal35, _ = strconv.ParseFloat(get("FocalLengthIn35mmFormat"), 64)
+		p.focal, _ = strconv.ParseFloat(get("FocalLength"), 64)
+		photos = append(photos, p)
+	}
+	sortPhotos(photos)
+	// Exiftool has complained about the files it couldn't read, and
+	// there's no row for them.
+	cmd.Wait()
+	for n := <-sent - len(photos); n > 0; n-- {
+		fail()
+	}
+	return photos
+}
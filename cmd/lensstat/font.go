@@ -0,0 +1,76 @@
+package main
+
+import "strings"
+
+// Glyphs is a 3x5 pixel font for the PNG charts, rows from the top.
+// Lower case letters are drawn as upper case, and characters without
+// a glyph as ?.
+var glyphs = map[rune]string{
+	'0':  "###|#.#|#.#|#.#|###",
+	'1':  ".#.|##.|.#.|.#.|###",
+	'2':  "##.|..#|.#.|#..|###",
+	'3':  "##.|..#|.#.|..#|##.",
+	'4':  "#.#|#.#|###|..#|..#",
+	'5':  "###|#..|##.|..#|##.",
+	'6':  ".##|#..|###|#.#|###",
+	'7':  "###|..#|.#.|.#.|.#.",
+	'8':  "###|#.#|###|#.#|###",
+	'9':  "###|#.#|###|..#|##.",
+	'A':  ".#.|#.#|###|#.#|#.#",
+	'B':  "##.|#.#|##.|#.#|##.",
+	'C':  ".##|#..|#..|#..|.##",
+	'D':  "##.|#.#|#.#|#.#|##.",
+	'E':  "###|#..|##.|#..|###",
+	'F':  "###|#..|##.|#..|#..",
+	'G':  ".##|#..|#.#|#.#|.##",
+	'H':  "#.#|#.#|###|#.#|#.#",
+	'I':  "###|.#.|.#.|.#.|###",
+	'J':  "..#|..#|..#|#.#|.#.",
+	'K':  "#.#|#.#|##.|#.#|#.#",
+	'L':  "#..|#..|#..|#..|###",
+	'M':  "#.#|###|###|#.#|#.#",
+	'N':  "##.|#.#|#.#|#.#|#.#",
+	'O':  ".#.|#.#|#.#|#.#|.#.",
+	'P':  "##.|#.#|##.|#..|#..",
+	'Q':  ".#.|#.#|#.#|##.|.##",
+	'R':  "##.|#.#|##.|#.#|#.#",
+	'S':  ".##|#..|.#.|..#|##.",
+	'T':  "###|.#.|.#.|.#.|.#.",
+	'U':  "#.#|#.#|#.#|#.#|###",
+	'V':  "#.#|#.#|#.#|#.#|.#.",
+	'W':  "#.#|#.#|###|###|#.#",
+	'X':  "#.#|#.#|.#.|#.#|#.#",
+	'Y':  "#.#|#.#|.#.|.#.|.#.",
+	'Z':  "###|..#|.#.|#..|###",
+	' ':  "...|...|...|...|...",
+	'-':  "...|...|###|...|...",
+	'.':  "...|...|...|...|.#.",
+	',':  "...|...|...|.#.|#..",
+	':':  "...|.#.|...|.#.|...",
+	'/':  "..#|..#|.#.|#..|#..",
+	'(':  ".#.|#..|#..|#..|.#.",
+	')':  ".#.|..#|..#|..#|.#.",
+	'<':  "..#|.#.|#..|.#.|..#",
+	'>':  "#..|.#.|..#|.#.|#..",
+	'?':  "##.|..#|.#.|...|.#.",
+	'!':  ".#.|.#.|.#.|...|.#.",
+	'+':  "...|.#.|###|.#.|...",
+	'=':  "...|###|...|###|...",
+	'_':  "...|...|...|...|###",
+	'*':  "#.#|.#.|#.#|...|...",
+	'%':  "#.#|..#|.#.|#..|#.#",
+	'&':  ".#.|#.#|.#.|#.#|.##",
+	'\'': ".#.|.#.|...|...|...",
+}
+
+// Glyph returns the rows of the glyph of r.
+func glyph(r rune) []string {
+	g, ok := glyphs[r]
+	if !ok {
+		g, ok = glyphs[[]rune(strings.ToUpper(string(r)))[0]]
+	}
+	if !ok {
+		g = glyphs['?']
+	}
+	return strings.Split(g, "|")
+}
@@ -1,78 +1,309 @@
+/*
+lensstat: focal length statistics
+	lensstat [-exiftool] [-r] [-a] [-ext list] [-j n] [-by key] [-w mm | -log n | -snap] [-primes list] [-min mm] [-max mm] [-format f] [-v] [-o file] file...
+
+Lensstat prints the distribution of the 35mm-equivalent focal lengths
+of the photos in the given files, as recorded in their EXIF data.
+
+With -r, directory arguments are walked recursively, and the files
+in them whose extension is in the comma separated list given by
+-ext are read. Like in lsr, hidden files and directories are skipped,
+unless -a is given. The files are read by -j workers at the same
+time, by default one per CPU.
+
+JPEG and TIFF files are understood, as well as the raw files based
+on TIFF, like DNG, CR2, NEF, ARW, and Fujifilm RAF files. With
+-exiftool, the EXIF data is read by exiftool(1) instead, which knows
+many more formats.
+
+With -by, which may be camera, lens, or year, a distribution is
+printed for each group of photos with the same camera body, lens, or
+year they were taken, followed by the distribution of all of them.
+Photos for which it's unknown are grouped last.
+
+Each millimeter gets its own row, unless -w gives a wider bin width,
+or -log gives a number of logarithmic bins per doubling of the focal
+length, or -snap is given, in which case focal lengths are counted
+with the nearest of the prime focal lengths in the comma separated
+list given by -primes. Rows are labeled with the lower bound of their
+bin, or with the prime; logarithmic bounds get decimals where whole
+millimeters wouldn't tell them apart. With -min or -max, the photos
+outside the range are counted apart. The 10th, 50th, and 90th
+percentiles of the focal lengths in range are printed after each
+distribution.
+
+With -format csv or tsv, the rows of the charts are written as
+comma or tab separated values instead, and with -format json, each
+chart is written as an object, with its percentiles. With -by, the
+rows and objects tell their kind of group, group for the photos with
+the same key, which is given, unknown, or all. With -v, a record for each photo is
+written instead: its file, camera, lens, date, actual and
+35mm-equivalent focal lengths, and the row it's counted in, as
+aligned columns by default. Rows below and above the range are
+labeled <min and >max, and the row of unknown focal lengths ?.
+
+With -o, the distribution is drawn as a bar chart in the given file
+instead, in SVG or PNG as its extension says. With -by, the bars of
+each group are drawn side by side in their own colour.
+
+Photos that don't record their 35mm-equivalent focal length have it
+computed from their actual focal length and the crop factor of their
+camera, if it's known. The others, and JPEG files without EXIF data,
+are counted as unknown. The number of files that couldn't be read is
+reported at the end.
+*/
 package main
 
 import (
-	"bytes"
-	"encoding/csv"
 	"flag"
 	"fmt"
-	"io"
 	"log"
+	"math"
 	"os"
-	"os/exec"
-	"regexp"
+	"runtime"
 	"sort"
-	"strconv"
+	"sync/atomic"
 
 	_ "mgk.ro/log"
 )
 
+var (
+	useExiftool = flag.Bool("exiftool", false, "read EXIF data with exiftool(1)")
+	flagR       = flag.Bool("r", false, "walk directories recursively")
+	flagA       = flag.Bool("a", false, "read hidden files and directories")
+	flagExt     = flag.String("ext", "jpg,jpeg,tif,tiff,dng,cr2,nef,nrw,arw,srf,sr2,raf,orf,rw2,pef", "`extensions` of the files to read in directories")
+	flagJ       = flag.Int("j", runtime.NumCPU(), "read `n` files at the same time")
+	flagBy      = flag.String("by", "", "group photos by `key`: camera, lens, or year")
+	flagW       = flag.Int("w", 1, "bin width in `mm`")
+	flagLog     = flag.Int("log", 0, "use `n` logarithmic bins per doubling of the focal length")
+	flagSnap    = flag.Bool("snap", false, "snap focal lengths to the nearest prime")
+	flagPrimes  = flag.String("primes", standardPrimes, "prime focal lengths for -snap, in mm")
+	flagMin     = flag.Float64("min", 0, "count focal lengths below `mm` apart")
+	flagMax     = flag.Float64("max", 0, "count focal lengths above `mm` apart")
+	flagFormat  = flag.String("format", "text", "output `format`: text, csv, tsv, or json")
+	flagV       = flag.Bool("v", false, "write a record for each photo instead of the counts")
+	flagO       = flag.String("o", "", "draw the chart in `file`, SVG or PNG")
+)
+
+// A photo is what we know about a photo.
+type photo struct {
+	file    string
+	focal35 float64 // 35mm-equivalent focal length in mm, 0 if unknown
+	focal   float64 // actual focal length in mm, 0 if unknown
+	lens    string
+	camera  string
+	date    string // EXIF date and time, YYYY:MM:DD HH:MM:SS
+}
+
 func usage() {
-	fmt.Fprint(os.Stderr, "usage: fstat file...\n")
+	fmt.Fprint(os.Stderr, "usage: lensstat [-exiftool] [-r] [-a] [-ext list] [-j n] [-by key] [-w mm | -log n | -snap] [-primes list] [-min mm] [-max mm] [-format f] [-v] [-o file] file...\n")
 	flag.PrintDefaults()
 	os.Exit(1)
 }
 
+// Skipped counts the files that couldn't be read.
+var skipped int32
+
+// Fail records that a file couldn't be read. It may be called from
+// any goroutine.
+func fail() {
+	atomic.AddInt32(&skipped, 1)
+}
+
 func main() {
 	flag.Usage = usage
 	flag.Parse()
 
-	if flag.NArg() == 0 {
+	if flag.NArg() == 0 || *flagJ < 1 {
+		usage()
+	}
+	var key func(*photo) string
+	if *flagBy != "" {
+		key = groupKeys[*flagBy]
+		if key == nil {
+			usage()
+		}
+	}
+	if !formats[*flagFormat] {
+		usage()
+	}
+	if *flagO != "" {
+		if *flagV || *flagFormat != "text" {
+			usage()
+		}
+		if _, err := chartFormat(*flagO); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *flagW < 1 || *flagLog < 0 || *flagMin < 0 || *flagMax < 0 {
+		usage()
+	}
+	if (*flagW != 1 && (*flagLog != 0 || *flagSnap)) || (*flagLog != 0 && *flagSnap) {
 		usage()
 	}
+	b := &bins{width: *flagW, perOctave: *flagLog, min: *flagMin, max: *flagMax}
+	if *flagSnap {
+		primes, err := parsePrimes(*flagPrimes)
+		if err != nil {
+			log.Fatal(err)
+		}
+		b.snap = primes
+	}
+
+	names := walk(flag.Args(), *flagR, *flagA, extensions(*flagExt))
+	var photos []*photo
+	if *useExiftool {
+		photos = exiftool(names)
+	} else {
+		photos = readAll(names, *flagJ)
+	}
+	var err error
+	switch {
+	case *flagO != "":
+		groups := []photoGroup{{photos: photos}}
+		if key != nil && len(photos) > 0 {
+			groups = group(photos, key)
+		}
+		err = writeChart(*flagO, groups, b, *flagBy)
+	case *flagV:
+		err = writeRecords(os.Stdout, *flagFormat, photos, b)
+	case *flagFormat != "text":
+		groups := []photoGroup{{photos: photos}}
+		if key != nil {
+			groups = append(group(photos, key), photoGroup{kind: kindAll, photos: photos})
+		}
+		err = writeCounts(os.Stdout, *flagFormat, groups, b)
+	default:
+		if key != nil {
+			groups := group(photos, key)
+			for _, g := range groups {
+				if g.kind == kindUnknown {
+					fmt.Printf("%s unknown (%d photos)\n", *flagBy, len(g.photos))
+				} else {
+					fmt.Printf("%s: %s (%d photos)\n", *flagBy, g.name, len(g.photos))
+				}
+				histogram(g.photos, b)
+				fmt.Println()
+			}
+			fmt.Printf("all (%d photos)\n", len(photos))
+		}
+		histogram(photos, b)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&skipped); n > 0 {
+		log.Printf("%d files skipped", n)
+		os.Exit(1)
+	}
+}
 
-	count := focals(flag.Args()...)
-	max := maxval(count)
+// Histogram prints the distribution of the focal lengths of photos,
+// bucketed by b.
+func histogram(photos []*photo, b *bins) {
+	d := focals(photos, b)
+	max := maxval(d.count)
+	for _, n := range []int{d.below, d.above, d.unknown} {
+		if n > max {
+			max = n
+		}
+	}
 
 	fmt.Println(" value  ------------------------ distribution ------------------------ count")
 
-	var keys []int
-	for k := range count {
-		keys = append(keys, k)
+	for _, r := range d.rows(b) {
+		fmt.Printf("%6s |%-62s %4d\n", r.label, stars(r.n, max), r.n)
 	}
-	sort.Ints(keys)
-	for _, k := range keys {
-		fmt.Printf("%6d |%-62s %4d\n", k, stars(count[k], max), count[k])
+	if len(d.values) > 0 {
+		fmt.Printf("p10 %gmm, median %gmm, p90 %gmm\n",
+			round(percentile(d.values, 10)), round(percentile(d.values, 50)), round(percentile(d.values, 90)))
 	}
 }
 
-func focals(files ...string) map[int]int {
-	r := csv.NewReader(exiftool(append([]string{"-q", "-FocalLengthIn35mmFormat", "-csv"}, files...)...))
-	records, err := r.ReadAll()
-	if err != nil {
-		log.Fatal(err)
+// Round rounds f to a tenth of a millimeter.
+func round(f float64) float64 {
+	return math.Round(f*10) / 10
+}
+
+// GroupKeys are the ways to group photos with -by.
+var groupKeys = map[string]func(*photo) string{
+	"camera": func(p *photo) string { return p.camera },
+	"lens":   func(p *photo) string { return p.lens },
+	"year": func(p *photo) string {
+		if len(p.date) < 4 || p.date[:4] == "0000" {
+			return ""
+		}
+		return p.date[:4]
+	},
+}
+
+// A photoGroup is a group of photos with the same key.
+type photoGroup struct {
+	kind   string // "" if the photos aren't grouped
+	name   string // the key, for kindGroup
+	photos []*photo
+}
+
+// Group kinds. They are kept apart from the names, which may be
+// anything, even "unknown" or "all".
+const (
+	kindGroup   = "group"   // photos with the same key
+	kindUnknown = "unknown" // photos whose key is unknown
+	kindAll     = "all"     // all the photos
+)
+
+// Group groups the photos by key, and returns the groups sorted by
+// name, with the photos whose key is unknown last.
+func group(photos []*photo, key func(*photo) string) []photoGroup {
+	m := make(map[string][]*photo)
+	for _, p := range photos {
+		k := key(p)
+		m[k] = append(m[k], p)
 	}
-	count := make(map[int]int)
-	for _, rec := range records[1:] { // skip header
-		re := regexp.MustCompile(`\d+`)
-		mm, err := strconv.Atoi(re.FindString(rec[1])) // second column
-		if err != nil {
-			log.Fatal(err)
+	var groups []photoGroup
+	for k, v := range m {
+		if k != "" {
+			groups = append(groups, photoGroup{kindGroup, k, v})
 		}
-		count[mm]++
 	}
-	return count
+	sort.Slice(groups, func(i, j int) bool { return groups[i].name < groups[j].name })
+	if v, ok := m[""]; ok {
+		groups = append(groups, photoGroup{kind: kindUnknown, photos: v})
+	}
+	return groups
 }
 
-func exiftool(params ...string) io.Reader {
-	cmd := exec.Command("exiftool", params...)
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = os.Stderr
-	err := cmd.Run()
-	if err != nil {
-		log.Fatal(err)
+// A dist is a distribution of focal lengths.
+type dist struct {
+	count        map[int]int // photos by bin
+	below, above int         // photos outside the range
+	unknown      int         // photos without a focal length
+	values       []float64   // focal lengths in range, sorted
+}
+
+// Focals counts the photos by 35mm-equivalent focal length, bucketed
+// by b.
+func focals(photos []*photo, b *bins) *dist {
+	d := &dist{count: make(map[int]int)}
+	for _, p := range photos {
+		f := equivalent(p)
+		if f == 0 {
+			d.unknown++
+			continue
+		}
+		switch b.inRange(f) {
+		case -1:
+			d.below++
+			continue
+		case 1:
+			d.above++
+			continue
+		}
+		d.count[b.bin(f)]++
+		d.values = append(d.values, f)
 	}
-	return &out
+	sort.Float64s(d.values)
+	return d
 }
 
 func maxval(m map[int]int) int {
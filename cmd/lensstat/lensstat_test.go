@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// Names returns the kinds and names of groups, and the files of their
+// photos.
+func names(groups []photoGroup) [][]string {
+	var got [][]string
+	for _, g := range groups {
+		s := []string{g.kind, g.name}
+		for _, p := range g.photos {
+			s = append(s, p.file)
+		}
+		got = append(got, s)
+	}
+	return got
+}
+
+func TestGroup(t *testing.T) {
+	photos := []*photo{
+		{file: "a", camera: "NIKON D850", lens: "50mm f/1.8", date: "2021:06:01 10:00:00"},
+		{file: "b", camera: "Canon EOS R5", date: "2023:04:30 09:00:00"},
+		{file: "c", lens: "50mm f/1.8", date: "0000:00:00 00:00:00"},
+		{file: "d", camera: "Canon EOS R5", lens: "RF50mm F1.8 STM", date: "2021:01:01 00:00:00"},
+		{file: "e", camera: "unknown", lens: "all", date: "202"},
+		{file: "f", camera: "all"},
+	}
+	tests := []struct {
+		by   string
+		want [][]string
+	}{
+		{"camera", [][]string{
+			{kindGroup, "Canon EOS R5", "b", "d"},
+			{kindGroup, "NIKON D850", "a"},
+			{kindGroup, "all", "f"},
+			{kindGroup, "unknown", "e"},
+			{kindUnknown, "", "c"},
+		}},
+		{"lens", [][]string{
+			{kindGroup, "50mm f/1.8", "a", "c"},
+			{kindGroup, "RF50mm F1.8 STM", "d"},
+			{kindGroup, "all", "e"},
+			{kindUnknown, "", "b", "f"},
+		}},
+		{"year", [][]string{
+			{kindGroup, "2021", "a", "d"},
+			{kindGroup, "2023", "b"},
+			{kindUnknown, "", "c", "e", "f"},
+		}},
+	}
+	for _, tt := range tests {
+		got := names(group(photos, groupKeys[tt.by]))
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("-by %s: got %q, want %q", tt.by, got, tt.want)
+		}
+	}
+	if got := group(nil, groupKeys["camera"]); len(got) != 0 {
+		t.Errorf("no photos: got %q", names(got))
+	}
+}
+
+// TestGroupNames checks that groups named like the kinds of groups
+// are told apart from them.
+func TestGroupNames(t *testing.T) {
+	photos := []*photo{
+		{camera: "unknown", focal35: 50},
+		{focal35: 35},
+	}
+	groups := append(group(photos, groupKeys["camera"]), photoGroup{kind: kindAll, photos: photos})
+	var buf bytes.Buffer
+	if err := writeCounts(&buf, "csv", groups, &bins{width: 1}); err != nil {
+		t.Fatal(err)
+	}
+	want := "kind,group,value,count\n" +
+		"group,unknown,50,1\n" +
+		"unknown,,35,1\n" +
+		"all,,35,1\n" +
+		"all,,50,1\n"
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// Formats are the output formats of -format.
+var formats = map[string]bool{"text": true, "csv": true, "tsv": true, "json": true}
+
+// A row is a row of a distribution.
+type row struct {
+	label string
+	n     int
+}
+
+// Rows returns the rows of d that aren't empty: the photos below the
+// range, the bins, the photos above the range, and the photos without
+// a focal length, labeled ?.
+func (d *dist) rows(b *bins) []row {
+	var rows []row
+	if d.below > 0 {
+		rows = append(rows, row{fmt.Sprintf("<%g", b.min), d.below})
+	}
+	var keys []int
+	for k := range d.count {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	for _, k := range keys {
+		rows = append(rows, row{b.binLabel(k), d.count[k]})
+	}
+	if d.above > 0 {
+		rows = append(rows, row{fmt.Sprintf(">%g", b.max), d.above})
+	}
+	if d.unknown > 0 {
+		rows = append(rows, row{"?", d.unknown})
+	}
+	return rows
+}
+
+// Label returns the label of the row photo p is counted in.
+func (b *bins) label(p *photo) string {
+	f := equivalent(p)
+	if f == 0 {
+		return "?"
+	}
+	switch b.inRange(f) {
+	case -1:
+		return fmt.Sprintf("<%g", b.min)
+	case 1:
+		return fmt.Sprintf(">%g", b.max)
+	}
+	return b.binLabel(b.bin(f))
+}
+
+// A summary is a distribution, as written by -format json.
+type summary struct {
+	Kind    string     `json:"kind,omitempty"`
+	Group   string     `json:"group,omitempty"`
+	Photos  int        `json:"photos"`
+	Bins    []binCount `json:"bins"`
+	Below   int        `json:"below,omitempty"`
+	Above   int        `json:"above,omitempty"`
+	Unknown int        `json:"unknown"`
+	P10     float64    `json:"p10,omitempty"`
+	Median  float64    `json:"median,omitempty"`
+	P90     float64    `json:"p90,omitempty"`
+}
+
+type binCount struct {
+	Value float64 `json:"value"`
+	Count int     `json:"count"`
+}
+
+// A record is what we know about a photo, as written by -v.
+type record struct {
+	File    string  `json:"file"`
+	Camera  string  `json:"camera"`
+	Lens    string  `json:"lens"`
+	Date    string  `json:"date"`
+	Focal   float64 `json:"focal"`
+	Focal35 float64 `json:"focal35"` // recorded or computed
+	Bin     string  `json:"bin"`
+}
+
+// WriteCounts writes the distributions of the groups to w in format.
+// The groups have a kind only with -by.
+func writeCounts(w io.Writer, format string, groups []photoGroup, b *bins) error {
+	if format == "json" {
+		sums := []summary{}
+		for _, g := range groups {
+			d := focals(g.photos, b)
+			s := summary{
+				Kind:    g.kind,
+				Group:   g.name,
+				Photos:  len(g.photos),
+				Bins:    []binCount{},
+				Below:   d.below,
+				Above:   d.above,
+				Unknown: d.unknown,
+			}
+			for k, n := range d.count {
+				s.Bins = append(s.Bins, binCount{b.value(k), n})
+			}
+			sort.Slice(s.Bins, func(i, j int) bool { return s.Bins[i].Value < s.Bins[j].Value })
+			if len(d.values) > 0 {
+				s.P10 = round(percentile(d.values, 10))
+				s.Median = round(percentile(d.values, 50))
+				s.P90 = round(percentile(d.values, 90))
+			}
+			sums = append(sums, s)
+		}
+		return writeJSON(w, sums)
+	}
+	header := []string{"value", "count"}
+	if groups[0].kind != "" {
+		header = append([]string{"kind", "group"}, header...)
+	}
+	var recs [][]string
+	for _, g := range groups {
+		for _, r := range focals(g.photos, b).rows(b) {
+			rec := []string{r.label, strconv.Itoa(r.n)}
+			if g.kind != "" {
+				rec = append([]string{g.kind, g.name}, rec...)
+			}
+			recs = append(recs, rec)
+		}
+	}
+	return writeTable(w, format, header, recs)
+}
+
+// WriteRecords writes a record for each photo to w in format.
+func writeRecords(w io.Writer, format string, photos []*photo, b *bins) error {
+	records := []record{}
+	for _, p := range photos {
+		records = append(records, record{
+			File:    p.file,
+			Camera:  p.camera,
+			Lens:    p.lens,
+			Date:    p.date,
+			Focal:   p.focal,
+			Focal35: round(equivalent(p)),
+			Bin:     b.label(p),
+		})
+	}
+	if format == "json" {
+		return writeJSON(w, records)
+	}
+	header := []string{"file", "camera", "lens", "date", "focal", "focal35", "bin"}
+	var recs [][]string
+	for _, r := range records {
+		recs = append(recs, []string{r.File, r.Camera, r.Lens, r.Date, number(r.Focal), number(r.Focal35), r.Bin})
+	}
+	return writeTable(w, format, header, recs)
+}
+
+// Number formats the focal length f, or returns "" if it's unknown.
+func number(f float64) string {
+	if f == 0 {
+		return ""
+	}
+	return strconv.FormatFloat(round(f), 'f', -1, 64)
+}
+
+// WriteTable writes the header and the records to w, as CSV, as tab
+// separated values, or, in text format, as aligned columns.
+func writeTable(w io.Writer, format string, header []string, recs [][]string) error {
+	if format == "text" {
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, strings.ToUpper(strings.Join(header, "\t")))
+		for _, rec := range recs {
+			for i, f := range rec {
+				if f == "" {
+					rec[i] = "-"
+				}
+			}
+			fmt.Fprintln(tw, strings.Join(rec, "\t"))
+		}
+		return tw.Flush()
+	}
+	cw := csv.NewWriter(w)
+	if format == "tsv" {
+		cw.Comma = '\t'
+	}
+	cw.Write(header)
+	cw.WriteAll(recs)
+	return cw.Error()
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
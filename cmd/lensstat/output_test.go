@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestPhotos has a photo below the range, two in range, one above it,
+// and one of unknown focal length and camera.
+var testPhotos = []*photo{
+	{file: "a.jpg", camera: "Canon EOS R5", lens: "RF50mm F1.8 STM", date: "2023:04:30 09:00:00", focal: 50, focal35: 50},
+	{file: "b.jpg", camera: "Canon EOS R5", lens: "RF16mm F2.8 STM", date: "2023:05:01 10:00:00", focal: 16, focal35: 16},
+	{file: "c, d.jpg", camera: "FUJIFILM X-T4", focal: 200},
+	{file: "d.jpg"},
+	{file: "e.jpg", camera: "FUJIFILM X-T4", focal: 23.4},
+}
+
+var testBins = &bins{width: 1, min: 28, max: 200}
+
+func TestWriteCounts(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		by     bool
+		photos []*photo
+		want   string
+	}{
+		{"csv", "csv", false, testPhotos, `value,count
+<28,1
+35,1
+50,1
+>200,1
+?,1
+`},
+		{"csv by camera", "csv", true, testPhotos, `kind,group,value,count
+group,Canon EOS R5,<28,1
+group,Canon EOS R5,50,1
+group,FUJIFILM X-T4,35,1
+group,FUJIFILM X-T4,>200,1
+unknown,,?,1
+all,,<28,1
+all,,35,1
+all,,50,1
+all,,>200,1
+all,,?,1
+`},
+		{"tsv by camera", "tsv", true, testPhotos[:2], "kind\tgroup\tvalue\tcount\n" +
+			"group\tCanon EOS R5\t<28\t1\n" +
+			"group\tCanon EOS R5\t50\t1\n" +
+			"all\t\t<28\t1\n" +
+			"all\t\t50\t1\n"},
+		{"json", "json", false, testPhotos, `[
+	{
+		"photos": 5,
+		"bins": [
+			{
+				"value": 35,
+				"count": 1
+			},
+			{
+				"value": 50,
+				"count": 1
+			}
+		],
+		"below": 1,
+		"above": 1,
+		"unknown": 1,
+		"p10": 35.1,
+		"median": 35.1,
+		"p90": 50
+	}
+]
+`},
+		{"json by camera", "json", true, testPhotos[2:4], `[
+	{
+		"kind": "group",
+		"group": "FUJIFILM X-T4",
+		"photos": 1,
+		"bins": [],
+		"above": 1,
+		"unknown": 0
+	},
+	{
+		"kind": "unknown",
+		"photos": 1,
+		"bins": [],
+		"unknown": 1
+	},
+	{
+		"kind": "all",
+		"photos": 2,
+		"bins": [],
+		"above": 1,
+		"unknown": 1
+	}
+]
+`},
+		{"csv empty", "csv", false, nil, "value,count\n"},
+		{"csv by camera empty", "csv", true, nil, "kind,group,value,count\n"},
+		{"json empty", "json", false, nil, `[
+	{
+		"photos": 0,
+		"bins": [],
+		"unknown": 0
+	}
+]
+`},
+		{"json by camera empty", "json", true, nil, `[
+	{
+		"kind": "all",
+		"photos": 0,
+		"bins": [],
+		"unknown": 0
+	}
+]
+`},
+	}
+	for _, tt := range tests {
+		groups := []photoGroup{{photos: tt.photos}}
+		if tt.by {
+			groups = append(group(tt.photos, groupKeys["camera"]), photoGroup{kind: kindAll, photos: tt.photos})
+		}
+		var buf bytes.Buffer
+		if err := writeCounts(&buf, tt.format, groups, testBins); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if buf.String() != tt.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.name, buf.String(), tt.want)
+		}
+	}
+}
+
+func TestWriteRecords(t *testing.T) {
+	tests := []struct {
+		format string
+		photos []*photo
+		want   string
+	}{
+		{"text", testPhotos, `FILE      CAMERA         LENS             DATE                 FOCAL  FOCAL35  BIN
+a.jpg     Canon EOS R5   RF50mm F1.8 STM  2023:04:30 09:00:00  50     50       50
+b.jpg     Canon EOS R5   RF16mm F2.8 STM  2023:05:01 10:00:00  16     16       <28
+c, d.jpg  FUJIFILM X-T4  -                -                    200    300      >200
+d.jpg     -              -                -                    -      -        ?
+e.jpg     FUJIFILM X-T4  -                -                    23.4   35.1     35
+`},
+		{"csv", testPhotos, `file,camera,lens,date,focal,focal35,bin
+a.jpg,Canon EOS R5,RF50mm F1.8 STM,2023:04:30 09:00:00,50,50,50
+b.jpg,Canon EOS R5,RF16mm F2.8 STM,2023:05:01 10:00:00,16,16,<28
+"c, d.jpg",FUJIFILM X-T4,,,200,300,>200
+d.jpg,,,,,,?
+e.jpg,FUJIFILM X-T4,,,23.4,35.1,35
+`},
+		{"tsv", testPhotos[2:4], "file\tcamera\tlens\tdate\tfocal\tfocal35\tbin\n" +
+			"c, d.jpg\tFUJIFILM X-T4\t\t\t200\t300\t>200\n" +
+			"d.jpg\t\t\t\t\t\t?\n"},
+		{"json", testPhotos[3:5], `[
+	{
+		"file": "d.jpg",
+		"camera": "",
+		"lens": "",
+		"date": "",
+		"focal": 0,
+		"focal35": 0,
+		"bin": "?"
+	},
+	{
+		"file": "e.jpg",
+		"camera": "FUJIFILM X-T4",
+		"lens": "",
+		"date": "",
+		"focal": 23.4,
+		"focal35": 35.1,
+		"bin": "35"
+	}
+]
+`},
+		{"text", nil, "FILE  CAMERA  LENS  DATE  FOCAL  FOCAL35  BIN\n"},
+		{"csv", nil, "file,camera,lens,date,focal,focal35,bin\n"},
+		{"json", nil, "[]\n"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := writeRecords(&buf, tt.format, tt.photos, testBins); err != nil {
+			t.Errorf("%s, %d photos: %v", tt.format, len(tt.photos), err)
+			continue
+		}
+		if buf.String() != tt.want {
+			t.Errorf("%s, %d photos: got\n%s\nwant\n%s", tt.format, len(tt.photos), buf.String(), tt.want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io/fs"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Hidden reports whether the file name is hidden, like lsr does.
+func hidden(name string) bool {
+	ok, _ := filepath.Match(".?*", filepath.Base(name))
+	return ok
+}
+
+// Extensions returns the set of file name extensions in the comma
+// separated list s, lower case and with their dot.
+func extensions(s string) map[string]bool {
+	exts := make(map[string]bool)
+	for _, e := range strings.Split(s, ",") {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if e == "" {
+			continue
+		}
+		if !strings.HasPrefix(e, ".") {
+			e = "." + e
+		}
+		exts[e] = true
+	}
+	return exts
+}
+
+// Walk sends the names of the files to read on the returned channel,
+// and closes it when done. File arguments are sent as they are. With
+// recurse, directories are walked, and the files in them with one of
+// the extensions exts are sent; hidden files and directories are
+// skipped unless all is set. Otherwise directories are an error.
+func walk(args []string, recurse, all bool, exts map[string]bool) <-chan string {
+	c := make(chan string, 64)
+	go func() {
+		defer close(c)
+		for _, arg := range args {
+			err := filepath.WalkDir(arg, func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
+					log.Print(err)
+					fail()
+					return nil
+				}
+				if path == arg && !d.IsDir() {
+					c <- path
+					return nil
+				}
+				if path == arg && !recurse {
+					log.Printf("%s: is a directory", path)
+					fail()
+					return filepath.SkipDir
+				}
+				if !all && path != arg && hidden(path) {
+					if d.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+				if d.Type().IsRegular() && exts[strings.ToLower(filepath.Ext(path))] {
+					c <- path
+				}
+				return nil
+			})
+			if err != nil {
+				log.Print(err)
+				fail()
+			}
+		}
+	}()
+	return c
+}
+
+// ReadAll reads the EXIF data of the named files with n workers,
+// and returns the photos sorted by file name.
+func readAll(names <-chan string, n int) []*photo {
+	results := make(chan *photo, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range names {
+				p, err := readExif(name)
+				if err != nil {
+					log.Print(err)
+				}
+				results <- p // nil on failure
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	var photos []*photo
+	for p := range results {
+		if p == nil {
+			fail()
+			continue
+		}
+		photos = append(photos, p)
+	}
+	sortPhotos(photos)
+	return photos
+}
+
+func sortPhotos(photos []*photo) {
+	sort.Slice(photos, func(i, j int) bool { return photos[i].file < photos[j].file })
+}
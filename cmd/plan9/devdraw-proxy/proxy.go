@@ -1,49 +1,160 @@
 /*
-devdraw-proxy: fake devdraw
+devdraw-proxy: fake devdraw and generic stdio forwarder
 	DEVDRAW_SERVER=net!addr DEVDRAW=devdraw-proxy cmd
+	SERVICE_SERVER=net!addr devdraw-proxy -s service
 
 This tool masquarades as devdraw for plan9port binaries when
 DEVDRAW=devdraw-proxy. It relays the protocol to the devdraw server
 specified by DEVDRAW_SERVER.
 
+More generally, it relays its standard input and output to the
+server of the service selected by -s, whose address is found in
+the upper-cased service name followed by _SERVER. Without -s, the
+service is named after the program, minus its -proxy suffix, so
+a plumb-proxy link to this program forwards to PLUMB_SERVER. The
+services, and the local programs plan9-ssh starts for them, are
+listed in mgk.ro/cmd/plan9/internal/service.
+
+Inside a persistent plan9-shell session, where PLAN9_SESSION is set,
+the connection is made resumable: if it's lost, the proxy keeps
+dialing the server for up to a day, and picks up where it left off,
+so the client never notices.
+
+When the client closes its end, the write side of the connection to
+the server is shut down, and the proxy keeps relaying until the server
+closes its end as well. A peer going away is not an error. The exit
+status is 0 on success, 1 for usage errors, 2 if the server can't be
+reached, and 3 if the relay fails midway.
+
 This program is not intended to be called directly by the user, but
 by plan9port graphical programs.
 */
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
-	"mgk.ro/net/netutil"
+	"mgk.ro/cmd/plan9/internal/resume"
+	"mgk.ro/cmd/plan9/internal/service"
 	_ "mgk.ro/log"
+	"mgk.ro/net/netutil"
 )
 
-var usageString = "usage: DEVDRAW_SERVER=net!addr DEVDRAW=devdraw-proxy cmd\n"
+var svc = flag.String("s", "", "name of the forwarded service")
+
+var usageString = `usage: DEVDRAW_SERVER=net!addr DEVDRAW=devdraw-proxy cmd
+       SERVICE_SERVER=net!addr devdraw-proxy -s service
+Options:
+`
+
+// Exit statuses.
+const (
+	exitUsage = 1
+	exitDial  = 2
+	exitRelay = 3
+)
+
+// RedialTimeout is how long a resumable connection is redialed before
+// giving up.
+const redialTimeout = 24 * time.Hour
 
 func usage() {
 	fmt.Fprint(os.Stderr, usageString)
-	os.Exit(1)
+	flag.PrintDefaults()
+	os.Exit(exitUsage)
 }
 
 func main() {
 	flag.Usage = usage
 	flag.Parse()
 
-	conn, err := netutil.Dial(os.Getenv("DEVDRAW_SERVER"))
+	// Get EPIPE instead of dying when the client goes away.
+	signal.Ignore(syscall.SIGPIPE)
+
+	name := *svc
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(os.Args[0]), "-proxy")
+	}
+	if _, ok := service.Lookup(name); !ok {
+		log.Printf("unknown service %q", name)
+		os.Exit(exitUsage)
+	}
+	addr := os.Getenv(service.ServerVar(name))
+	var conn io.ReadWriteCloser
+	var err error
+	if os.Getenv("PLAN9_SESSION") != "" {
+		conn, err = resume.Dial(func() (net.Conn, error) {
+			return netutil.Dial(addr)
+		}, redialTimeout)
+	} else {
+		conn, err = netutil.Dial(addr)
+	}
 	if err != nil {
-		log.Fatal(err)
+		log.Print(err)
+		os.Exit(exitDial)
+	}
+	if err := relay(conn, os.Stdin, os.Stdout); err != nil {
+		log.Print(err)
+		os.Exit(exitRelay)
 	}
-	go proxy(os.Stdin, conn)
-	proxy(conn, os.Stdout)
 }
 
-func proxy(dst io.Writer, src io.Reader) {
-	_, err := io.Copy(dst, src)
-	if err != nil {
-		log.Fatal(err)
+// Relay copies r to conn and conn to w. When r is exhausted, the
+// write side of conn is shut down, if conn supports it, but the relay
+// continues until conn reaches EOF. Conn is closed on return. Errors
+// caused by either peer going away are not reported.
+func relay(conn io.ReadWriteCloser, r io.Reader, w io.Writer) error {
+	errc := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(conn, r)
+		if err == nil {
+			err = closeWrite(conn)
+		}
+		errc <- err
+	}()
+	_, err := io.Copy(w, conn)
+	conn.Close()
+	if err != nil && !peerClosed(err) {
+		return err
+	}
+	// The server is done. If the other direction already failed,
+	// report it, otherwise don't wait for the client to finish.
+	select {
+	case err := <-errc:
+		if err != nil && !peerClosed(err) {
+			return err
+		}
+	default:
 	}
+	return nil
+}
+
+// CloseWrite shuts down the writing side of conn, if conn supports
+// half-close.
+func closeWrite(conn io.Writer) error {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		return c.CloseWrite()
+	}
+	return nil
+}
+
+// PeerClosed reports whether err is the result of the other end
+// closing the connection, rather than a real failure.
+func peerClosed(err error) bool {
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.ECONNRESET)
 }
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// TestRelayHalfClose checks that the end of the client's input reaches
+// the server as EOF, and that the server's reply is still relayed.
+func TestRelayHalfClose(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	got := make(chan string, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			got <- err.Error()
+			return
+		}
+		defer c.Close()
+		b, err := io.ReadAll(c) // returns only on half-close
+		if err != nil {
+			got <- err.Error()
+			return
+		}
+		got <- string(b)
+		io.WriteString(c, "reply")
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := relay(conn, strings.NewReader("request"), &out); err != nil {
+		t.Fatalf("relay: %v", err)
+	}
+	if s := <-got; s != "request" {
+		t.Errorf("server got %q, want %q", s, "request")
+	}
+	if out.String() != "reply" {
+		t.Errorf("client got %q, want %q", out.String(), "reply")
+	}
+}
+
+// TestRelayPeerEOF checks that the server closing the connection while
+// the client is still connected is not an error.
+func TestRelayPeerEOF(t *testing.T) {
+	client, server := net.Pipe()
+	go func() {
+		io.WriteString(server, "bye")
+		server.Close()
+	}()
+	pr, pw := io.Pipe() // the client never sends anything
+	defer pw.Close()
+	var out bytes.Buffer
+	if err := relay(client, pr, &out); err != nil {
+		t.Fatalf("relay: %v", err)
+	}
+	if out.String() != "bye" {
+		t.Errorf("client got %q, want %q", out.String(), "bye")
+	}
+}
+
+type errWriter struct{ err error }
+
+func (w errWriter) Write([]byte) (int, error) { return 0, w.err }
+
+// TestRelayError checks that a real failure is reported.
+func TestRelayError(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go io.WriteString(server, "data")
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	boom := errors.New("boom")
+	if err := relay(client, pr, errWriter{boom}); !errors.Is(err, boom) {
+		t.Fatalf("relay returned %v, want %v", err, boom)
+	}
+}
+
+func TestPeerClosed(t *testing.T) {
+	for _, err := range []error{io.EOF, io.ErrClosedPipe, net.ErrClosed} {
+		if !peerClosed(err) {
+			t.Errorf("peerClosed(%v) = false", err)
+		}
+	}
+	if peerClosed(errors.New("boom")) {
+		t.Error("peerClosed(boom) = true")
+	}
+}
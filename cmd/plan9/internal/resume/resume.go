@@ -0,0 +1,516 @@
+/*
+Package resume implements byte streams that survive the loss of the
+connection they are carried over.
+
+A Conn is attached to a transport connection. When the transport
+fails, the Conn is detached: writes are buffered and reads block
+until a new transport is attached. Both ends keep the data they have
+sent until the peer acknowledges it, and replay it after reattaching,
+so nothing is lost or duplicated.
+
+On the wire, the client opens with the line
+
+	resume id received
+
+and the server answers with
+
+	id received
+
+where id identifies the stream, 0 asking for a new one, and received
+is the number of bytes received so far. Servers pick random ids, so
+that a client redialing after the server restarted isn't mistaken
+for the client of another stream. A server that doesn't know the
+stream answers with id 0. Then both ends exchange frames: a data
+frame is 'd', a 4-byte big-endian length, and the data; an ack frame
+is 'a' and the 8-byte big-endian count of bytes received; an EOF
+frame, sent after the last data, is 'e'.
+*/
+package resume // import "mgk.ro/cmd/plan9/internal/resume"
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Magic starts the client's handshake, so that servers can tell
+// resumable streams apart from plain ones.
+const Magic = "resume "
+
+const (
+	frameData = 'd'
+	frameAck  = 'a'
+	frameEOF  = 'e'
+)
+
+const (
+	maxFrame = 32 << 10 // largest data frame
+	ackEvery = 64 << 10 // bytes received between acks
+)
+
+var (
+	// ErrClosed is returned when using a closed Conn.
+	ErrClosed = errors.New("resume: use of closed connection")
+
+	// ErrGone is returned when the server doesn't know the stream.
+	ErrGone = errors.New("resume: stream gone")
+)
+
+// A Conn is a resumable byte stream.
+type Conn struct {
+	ID uint64
+
+	wmu sync.Mutex // serializes writes to the transport
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	nc      net.Conn // current transport, nil if detached
+	unacked []byte   // sent, but not acknowledged
+	acked   uint64   // bytes acknowledged by the peer
+	recvd   uint64   // bytes received
+	lastAck uint64   // recvd when last acknowledged
+	rbuf    []byte   // received, but not read
+	reof    bool     // peer is done writing
+	weof    bool     // we are done writing
+	closed  bool
+}
+
+// New returns a new, detached, Conn.
+func New(id uint64) *Conn {
+	c := &Conn{ID: id}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// Suspend detaches c from its transport, if any, and returns the
+// number of bytes received, to be sent to the peer before reattaching.
+func (c *Conn) Suspend() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.nc != nil {
+		c.nc.Close()
+		c.nc = nil
+		c.cond.Broadcast()
+	}
+	return c.recvd
+}
+
+// Attach attaches c to nc, after the handshake. Frames are read from
+// r, which buffers nc. The peer has received peerRecvd bytes; the rest
+// is sent again.
+func (c *Conn) Attach(nc net.Conn, r io.Reader, peerRecvd uint64) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		nc.Close()
+		return ErrClosed
+	}
+	if c.nc != nil {
+		c.nc.Close()
+	}
+	sent := c.acked + uint64(len(c.unacked))
+	if peerRecvd < c.acked || peerRecvd > sent {
+		c.mu.Unlock()
+		nc.Close()
+		return errors.New("resume: peer out of sync")
+	}
+	c.unacked = c.unacked[peerRecvd-c.acked:]
+	c.acked = peerRecvd
+	c.lastAck = c.recvd
+	c.nc = nc
+	replay, weof := c.unacked, c.weof
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	go c.read(nc, r)
+	go c.ack(nc)
+	err := writeData(nc, replay)
+	if err == nil && weof {
+		_, err = nc.Write([]byte{frameEOF})
+	}
+	if err != nil {
+		c.detach(nc)
+	}
+	return nil
+}
+
+// Detach detaches c from nc, if it's still the current transport.
+func (c *Conn) detach(nc net.Conn) {
+	c.mu.Lock()
+	if c.nc == nc {
+		c.nc = nil
+		c.cond.Broadcast()
+	}
+	c.mu.Unlock()
+	nc.Close()
+}
+
+// Read reads frames from the transport nc until it fails.
+func (c *Conn) read(nc net.Conn, r io.Reader) {
+	br := bufio.NewReader(r)
+	var hdr [8]byte
+	for {
+		typ, err := br.ReadByte()
+		if err != nil {
+			c.detach(nc)
+			return
+		}
+		switch typ {
+		case frameData:
+			if _, err := io.ReadFull(br, hdr[:4]); err != nil {
+				c.detach(nc)
+				return
+			}
+			n := binary.BigEndian.Uint32(hdr[:4])
+			if n > maxFrame {
+				c.detach(nc)
+				return
+			}
+			buf := make([]byte, n)
+			if _, err := io.ReadFull(br, buf); err != nil {
+				c.detach(nc)
+				return
+			}
+			c.mu.Lock()
+			if c.nc != nc {
+				c.mu.Unlock()
+				return
+			}
+			c.rbuf = append(c.rbuf, buf...)
+			c.recvd += uint64(n)
+			c.cond.Broadcast()
+			c.mu.Unlock()
+		case frameAck:
+			if _, err := io.ReadFull(br, hdr[:]); err != nil {
+				c.detach(nc)
+				return
+			}
+			n := binary.BigEndian.Uint64(hdr[:])
+			c.mu.Lock()
+			if c.nc == nc && n > c.acked && n <= c.acked+uint64(len(c.unacked)) {
+				c.unacked = c.unacked[n-c.acked:]
+				c.acked = n
+				c.cond.Broadcast()
+			}
+			c.mu.Unlock()
+		case frameEOF:
+			c.mu.Lock()
+			if c.nc == nc {
+				c.reof = true
+				c.cond.Broadcast()
+			}
+			c.mu.Unlock()
+		default:
+			c.detach(nc)
+			return
+		}
+	}
+}
+
+// Ack acknowledges received data on nc, until nc is detached. Acks
+// are sent by their own goroutine, so that reading never blocks on
+// writing.
+func (c *Conn) ack(nc net.Conn) {
+	var buf [9]byte
+	buf[0] = frameAck
+	for {
+		c.mu.Lock()
+		for c.nc == nc && c.recvd-c.lastAck < ackEvery && !(c.reof && c.recvd != c.lastAck) {
+			c.cond.Wait()
+		}
+		if c.nc != nc {
+			c.mu.Unlock()
+			return
+		}
+		c.lastAck = c.recvd
+		binary.BigEndian.PutUint64(buf[1:], c.recvd)
+		c.mu.Unlock()
+
+		c.wmu.Lock()
+		_, err := nc.Write(buf[:])
+		c.wmu.Unlock()
+		if err != nil {
+			c.detach(nc)
+			return
+		}
+	}
+}
+
+// WriteData writes p to w as data frames.
+func writeData(w io.Writer, p []byte) error {
+	var hdr [5]byte
+	hdr[0] = frameData
+	for len(p) > 0 {
+		n := len(p)
+		if n > maxFrame {
+			n = maxFrame
+		}
+		binary.BigEndian.PutUint32(hdr[1:], uint32(n))
+		if _, err := w.Write(hdr[:]); err != nil {
+			return err
+		}
+		if _, err := w.Write(p[:n]); err != nil {
+			return err
+		}
+		p = p[n:]
+	}
+	return nil
+}
+
+// Read reads data from c. It blocks while c is detached.
+func (c *Conn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.rbuf) == 0 && !c.reof && !c.closed {
+		c.cond.Wait()
+	}
+	if len(c.rbuf) > 0 {
+		n := copy(p, c.rbuf)
+		c.rbuf = c.rbuf[n:]
+		return n, nil
+	}
+	if c.reof {
+		return 0, io.EOF
+	}
+	return 0, ErrClosed
+}
+
+// Write writes data to c. While c is detached, the data is buffered.
+func (c *Conn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.mu.Lock()
+	if c.closed || c.weof {
+		c.mu.Unlock()
+		return 0, ErrClosed
+	}
+	c.unacked = append(c.unacked, p...)
+	nc := c.nc
+	c.mu.Unlock()
+	if nc != nil {
+		if err := writeData(nc, p); err != nil {
+			c.detach(nc)
+		}
+	}
+	return len(p), nil
+}
+
+// CloseWrite tells the peer that no more data will be written.
+func (c *Conn) CloseWrite() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	if c.weof {
+		c.mu.Unlock()
+		return nil
+	}
+	c.weof = true
+	nc := c.nc
+	c.mu.Unlock()
+	if nc != nil {
+		if _, err := nc.Write([]byte{frameEOF}); err != nil {
+			c.detach(nc)
+		}
+	}
+	return nil
+}
+
+// Drain waits at most timeout until all the data written to c has
+// been acknowledged by the peer, and reports whether it was.
+func (c *Conn) Drain(timeout time.Duration) bool {
+	t := time.AfterFunc(timeout, func() {
+		c.mu.Lock()
+		c.cond.Broadcast()
+		c.mu.Unlock()
+	})
+	defer t.Stop()
+	deadline := time.Now().Add(timeout)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.unacked) > 0 && !c.closed && time.Now().Before(deadline) {
+		c.cond.Wait()
+	}
+	return len(c.unacked) == 0
+}
+
+// Close closes c and its transport.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if c.nc != nil {
+		c.nc.Close()
+		c.nc = nil
+	}
+	c.cond.Broadcast()
+	return nil
+}
+
+// WaitDetached waits until c has no transport. It reports false if c
+// was closed instead.
+func (c *Conn) waitDetached() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.nc != nil && !c.closed {
+		c.cond.Wait()
+	}
+	return !c.closed
+}
+
+// Dial returns a new stream carried over connections returned by
+// dial. When the connection fails, dial is called again, backing off
+// between attempts, until it succeeds or timeout elapses, in which
+// case the stream is closed.
+func Dial(dial func() (net.Conn, error), timeout time.Duration) (*Conn, error) {
+	nc, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	c := New(0)
+	if err := c.handshake(nc); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	go c.redial(dial, timeout)
+	return c, nil
+}
+
+// Handshake performs the client side of the handshake on nc and
+// attaches c to it.
+func (c *Conn) handshake(nc net.Conn) error {
+	recvd := c.Suspend()
+	if _, err := fmt.Fprintf(nc, "%s%d %d\n", Magic, c.ID, recvd); err != nil {
+		return err
+	}
+	br := bufio.NewReader(nc)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	var id, peerRecvd uint64
+	if _, err := fmt.Sscanf(line, "%d %d\n", &id, &peerRecvd); err != nil {
+		return fmt.Errorf("resume: bad handshake %q", line)
+	}
+	if id == 0 {
+		return ErrGone
+	}
+	c.ID = id
+	return c.Attach(nc, br, peerRecvd)
+}
+
+func (c *Conn) redial(dial func() (net.Conn, error), timeout time.Duration) {
+	for c.waitDetached() {
+		deadline := time.Now().Add(timeout)
+		backoff := 100 * time.Millisecond
+		for {
+			nc, err := dial()
+			if err == nil {
+				err = c.handshake(nc)
+				if err == nil {
+					break
+				}
+				nc.Close()
+				if errors.Is(err, ErrGone) || errors.Is(err, ErrClosed) {
+					// The server finished with the stream
+					// while we were away.
+					c.mu.Lock()
+					c.reof = true
+					c.mu.Unlock()
+					c.Close()
+					return
+				}
+			}
+			if time.Now().After(deadline) {
+				c.Close()
+				return
+			}
+			time.Sleep(backoff)
+			if backoff < 5*time.Second {
+				backoff *= 2
+			}
+		}
+	}
+}
+
+// A Server keeps track of the streams of its clients.
+type Server struct {
+	mu    sync.Mutex
+	conns map[uint64]*Conn
+}
+
+// Accept performs the server side of the handshake on nc, whose data
+// is read through r. It returns the stream the client asked for, and
+// whether it is a new one. The caller must Remove new streams when
+// done with them.
+func (s *Server) Accept(nc net.Conn, r *bufio.Reader) (c *Conn, isNew bool, err error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, false, err
+	}
+	var id, peerRecvd uint64
+	if _, err := fmt.Sscanf(line, Magic+"%d %d\n", &id, &peerRecvd); err != nil {
+		return nil, false, fmt.Errorf("resume: bad handshake %q", line)
+	}
+	s.mu.Lock()
+	if s.conns == nil {
+		s.conns = make(map[uint64]*Conn)
+	}
+	if id == 0 {
+		if id, err = s.newID(); err != nil {
+			s.mu.Unlock()
+			return nil, false, err
+		}
+		c, isNew = New(id), true
+		s.conns[c.ID] = c
+	} else {
+		c = s.conns[id]
+	}
+	s.mu.Unlock()
+	if c == nil {
+		fmt.Fprintf(nc, "0 0\n")
+		return nil, false, ErrGone
+	}
+	recvd := c.Suspend()
+	if _, err := fmt.Fprintf(nc, "%d %d\n", c.ID, recvd); err != nil {
+		return c, isNew, err
+	}
+	return c, isNew, c.Attach(nc, r, peerRecvd)
+}
+
+// NewID returns a random stream id that's neither 0 nor in use.
+// It's called with s.mu held.
+func (s *Server) newID() (uint64, error) {
+	var b [8]byte
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			return 0, err
+		}
+		id := binary.BigEndian.Uint64(b[:])
+		if _, ok := s.conns[id]; id != 0 && !ok {
+			return id, nil
+		}
+	}
+}
+
+// Remove closes c and forgets about it.
+func (s *Server) Remove(c *Conn) {
+	s.mu.Lock()
+	delete(s.conns, c.ID)
+	s.mu.Unlock()
+	c.Close()
+}
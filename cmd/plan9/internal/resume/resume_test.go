@@ -0,0 +1,237 @@
+package resume
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A pipeServer serves streams over net.Pipe transports.
+type pipeServer struct {
+	s     Server
+	hold  sync.Mutex    // held to keep clients from redialing
+	conns chan *Conn    // new streams
+	nets  chan net.Conn // server ends of the transports
+}
+
+func newPipeServer() *pipeServer {
+	return &pipeServer{conns: make(chan *Conn, 10), nets: make(chan net.Conn, 10)}
+}
+
+// Dial returns the client end of a new transport, whose server end
+// is handed to the server.
+func (p *pipeServer) dial() (net.Conn, error) {
+	p.hold.Lock()
+	p.hold.Unlock()
+	cl, sv := net.Pipe()
+	go func() {
+		c, isNew, err := p.s.Accept(sv, bufio.NewReader(sv))
+		if err != nil {
+			return
+		}
+		p.nets <- sv
+		if isNew {
+			p.conns <- c
+		}
+	}()
+	return cl, nil
+}
+
+// Pair returns the two ends of a new stream, and the server end of
+// its transport.
+func pair(t *testing.T, p *pipeServer) (client, server *Conn, nc net.Conn) {
+	t.Helper()
+	client, err := Dial(p.dial, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	select {
+	case server = <-p.conns:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no stream accepted")
+	}
+	t.Cleanup(func() { p.s.Remove(server) })
+	select {
+	case nc = <-p.nets:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no transport accepted")
+	}
+	return client, server, nc
+}
+
+func readN(t *testing.T, r io.Reader, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(r, b)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read timed out")
+	}
+	return b
+}
+
+// Unacked returns the number of bytes c keeps for replay.
+func unacked(c *Conn) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.unacked)
+}
+
+func TestRoundTrip(t *testing.T) {
+	client, server, _ := pair(t, newPipeServer())
+	if client.ID == 0 || client.ID != server.ID {
+		t.Fatalf("client id %d, server id %d", client.ID, server.ID)
+	}
+	io.WriteString(client, "ping")
+	if b := readN(t, server, 4); string(b) != "ping" {
+		t.Errorf("server read %q", b)
+	}
+	io.WriteString(server, "pong")
+	server.CloseWrite()
+	b, err := io.ReadAll(client)
+	if err != nil || string(b) != "pong" {
+		t.Errorf("client read %q, %v; want pong", b, err)
+	}
+}
+
+// TestReconnect checks that a stream survives the loss of its
+// transport: writes made while detached are kept, and after the client
+// redials, both ends get exactly the data they missed.
+func TestReconnect(t *testing.T) {
+	p := newPipeServer()
+	client, server, nc := pair(t, p)
+	io.WriteString(server, "abc")
+	if b := readN(t, client, 3); string(b) != "abc" {
+		t.Fatalf("client read %q", b)
+	}
+	io.WriteString(client, "123")
+	if b := readN(t, server, 3); string(b) != "123" {
+		t.Fatalf("server read %q", b)
+	}
+
+	p.hold.Lock()
+	nc.Close()
+	if !server.waitDetached() || !client.waitDetached() {
+		t.Fatal("closed instead of detached")
+	}
+	// Both ends hold what they sent, unacknowledged.
+	if n := unacked(server); n != 3 {
+		t.Errorf("server keeps %d bytes, want 3", n)
+	}
+	if _, err := io.WriteString(server, "def"); err != nil {
+		t.Fatalf("write while detached: %v", err)
+	}
+	if _, err := io.WriteString(client, "456"); err != nil {
+		t.Fatalf("write while detached: %v", err)
+	}
+	p.hold.Unlock()
+
+	// The client redials by itself; the same server stream is
+	// reattached, not a new one.
+	select {
+	case <-p.nets:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client didn't redial")
+	}
+	select {
+	case c := <-p.conns:
+		t.Fatalf("new stream %d on redial", c.ID)
+	default:
+	}
+	if b := readN(t, client, 3); string(b) != "def" {
+		t.Errorf("client read %q after reconnecting, want def", b)
+	}
+	if b := readN(t, server, 3); string(b) != "456" {
+		t.Errorf("server read %q after reconnecting, want 456", b)
+	}
+}
+
+// TestReplay checks that data lost with the transport is sent again.
+func TestReplay(t *testing.T) {
+	p := newPipeServer()
+	client, server, nc := pair(t, p)
+
+	// Detach the server, then have it "send" data that never
+	// arrives: it stays unacknowledged.
+	p.hold.Lock()
+	server.Suspend()
+	nc.Close()
+	io.WriteString(server, "lost in transit")
+	p.hold.Unlock()
+
+	select {
+	case <-p.nets:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client didn't redial")
+	}
+	if b := readN(t, client, 15); string(b) != "lost in transit" {
+		t.Errorf("client read %q", b)
+	}
+}
+
+// TestAckTrimming checks that acknowledged data is dropped from the
+// replay buffer: every ackEvery bytes while data flows, and all of it
+// at the end of the stream.
+func TestAckTrimming(t *testing.T) {
+	client, server, _ := pair(t, newPipeServer())
+	data := bytes.Repeat([]byte("0123456789abcdef"), 3*ackEvery/16+1)
+	go server.Write(data)
+	if b := readN(t, client, len(data)); !bytes.Equal(b, data) {
+		t.Fatal("client read garbled data")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for unacked(server) > ackEvery && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := unacked(server); n > ackEvery {
+		t.Errorf("server keeps %d bytes, want at most %d", n, ackEvery)
+	}
+	server.CloseWrite()
+	if b, err := io.ReadAll(client); err != nil || len(b) != 0 {
+		t.Fatalf("client read %q, %v; want EOF", b, err)
+	}
+	if !server.Drain(5 * time.Second) {
+		t.Errorf("server keeps %d bytes after the client read them all", unacked(server))
+	}
+}
+
+func TestUnknownStream(t *testing.T) {
+	p := newPipeServer()
+	client, _, _ := pair(t, p)
+
+	// A restarted server doesn't know the stream, even though it
+	// may have streams of its own.
+	restarted := newPipeServer()
+	pair(t, restarted)
+	nc, _ := restarted.dial()
+	c := New(client.ID)
+	if err := c.handshake(nc); !errors.Is(err, ErrGone) {
+		t.Errorf("handshake with a restarted server: %v, want %v", err, ErrGone)
+	}
+}
+
+func TestIDs(t *testing.T) {
+	p := newPipeServer()
+	seen := make(map[uint64]bool)
+	for i := 0; i < 5; i++ {
+		client, _, _ := pair(t, p)
+		if client.ID == 0 || seen[client.ID] {
+			t.Errorf("stream %d got id %d", i, client.ID)
+		}
+		seen[client.ID] = true
+	}
+}
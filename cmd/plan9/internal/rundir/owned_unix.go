@@ -0,0 +1,15 @@
+//go:build !windows && !plan9
+
+package rundir
+
+import (
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// Owned reports whether the file described by fi belongs to us.
+func Owned(fi fs.FileInfo) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && int(st.Uid) == os.Getuid()
+}
@@ -0,0 +1,76 @@
+/*
+Package rundir manages the private per-user directories where the
+plan9 tools keep their sockets.
+*/
+package rundir // import "mgk.ro/cmd/plan9/internal/rundir"
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// Dir returns the private directory of the named program, creating it
+// if needed. It is $XDG_RUNTIME_DIR/name if XDG_RUNTIME_DIR is set,
+// or $TMPDIR/name.uid otherwise. Dir fails if the directory is not
+// ours; if it is, but others have access to it, access is revoked.
+func Dir(name string) (string, error) {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return mkdir(filepath.Join(dir, name))
+	}
+	return DirIn(os.TempDir(), name)
+}
+
+// DirIn is like Dir, but always returns parent/name.uid.
+func DirIn(parent, name string) (string, error) {
+	return mkdir(filepath.Join(parent, fmt.Sprintf("%s.%d", name, os.Getuid())))
+}
+
+func mkdir(dir string) (string, error) {
+	if err := os.Mkdir(dir, 0700); err != nil && !errors.Is(err, fs.ErrExist) {
+		return "", err
+	}
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return "", err
+	}
+	if !fi.IsDir() || !Owned(fi) {
+		return "", fmt.Errorf("%s: not a directory owned by us", dir)
+	}
+	if fi.Mode().Perm() != 0700 {
+		if err := os.Chmod(dir, 0700); err != nil {
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// Clean removes the stale unix domain sockets in dir, those nobody
+// listens on, left over by crashed sessions. Live sockets are probed
+// by connecting to them and hanging up without sending anything, which
+// the servers of the plan9 tools ignore.
+func Clean(dir string) {
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, e := range ents {
+		if e.Type()&fs.ModeSocket == 0 {
+			continue
+		}
+		name := filepath.Join(dir, e.Name())
+		conn, err := net.DialTimeout("unix", name, time.Second)
+		if err == nil {
+			conn.Close()
+			continue
+		}
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			os.Remove(name)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+/*
+Package service describes the local helper programs that plan9-ssh
+makes available to the remote end.
+
+Every service is forwarded over its own socket. On the remote end,
+devdraw-proxy -s name dials the address found in the variable
+returned by ServerVar, and plan9-ssh starts the local command for
+every such connection, with its standard input and output tied to
+the connection.
+*/
+package service // import "mgk.ro/cmd/plan9/internal/service"
+
+import (
+	"os"
+	"runtime"
+	"strings"
+)
+
+// A Service is a local program started for every connection
+// forwarded from the remote end.
+type Service struct {
+	Name    string   // as passed to devdraw-proxy -s
+	Env     string   // variable that overrides Cmd, if set
+	Cmd     []string // default command line
+	Private bool     // never forwarded through a TCP port
+}
+
+// Table lists the known services. The clipboard services are private:
+// a TCP port on the remote end can be reached by every user of the
+// remote host, who could read or overwrite the local clipboard.
+var Table = []Service{
+	{"devdraw", "DEVDRAW", []string{"devdraw"}, false},
+	{"plumb", "PLUMB", []string{"plumb", "-i"}, false},
+	{"snarf", "SNARF", clipboard("pbcopy", "-i"), true},
+	{"paste", "PASTE", clipboard("pbpaste", "-o"), true},
+}
+
+// Clipboard returns the command line of the system clipboard helper.
+// On macOS it's prog, elsewhere it's xclip(1) with the dir option.
+func clipboard(prog, dir string) []string {
+	if runtime.GOOS == "darwin" {
+		return []string{prog}
+	}
+	return []string{"xclip", "-selection", "clipboard", dir}
+}
+
+// Lookup returns the service with the given name.
+func Lookup(name string) (Service, bool) {
+	for _, s := range Table {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return Service{}, false
+}
+
+// Command returns the command line to run for the service. If the
+// service's environment variable is set, it is split into fields
+// and used instead of the default.
+func (s Service) Command() []string {
+	if v := strings.Fields(os.Getenv(s.Env)); len(v) > 0 {
+		return v
+	}
+	return s.Cmd
+}
+
+// ServerVar returns the name of the environment variable that holds
+// the address of the named service on the remote end, for example
+// DEVDRAW_SERVER.
+func ServerVar(name string) string {
+	return strings.ToUpper(name) + "_SERVER"
+}
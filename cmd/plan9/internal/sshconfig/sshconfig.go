@@ -0,0 +1,294 @@
+/*
+Package sshconfig parses configuration files in the format of
+ssh_config(5).
+
+Only Host blocks and Include lines are understood. Match blocks never
+apply.
+*/
+package sshconfig // import "mgk.ro/cmd/plan9/internal/sshconfig"
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A Config is a parsed configuration file.
+type Config struct {
+	blocks []block
+}
+
+// A block is a list of settings that apply to the hosts matching its
+// pattern lists. The settings before the first Host line are in a
+// block that applies to all hosts. Blocks from included files must
+// also match the patterns of the block the Include line is in.
+type block struct {
+	patterns [][]string // nil means any host
+	match    bool       // in a Match block, which never applies
+	settings []setting
+}
+
+type setting struct {
+	key  string // lower case
+	args []string
+}
+
+// MaxDepth is how deep Include lines may nest, as in ssh(1).
+const maxDepth = 16
+
+// ParseFile parses the named file. A missing file is an empty
+// configuration. Included files are relative to the directory of the
+// file.
+func ParseFile(name string) (*Config, error) {
+	c := &Config{blocks: []block{{}}}
+	if err := c.parseFile(name, block{}, 0); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Parse parses a configuration. Keywords are case-insensitive, and
+// separated from their arguments by white space or an equal sign.
+// Arguments may be double-quoted. Included files are relative to
+// $HOME/.ssh, as for the user's configuration file.
+func Parse(r io.Reader) (*Config, error) {
+	c := &Config{blocks: []block{{}}}
+	home, _ := os.UserHomeDir()
+	if err := c.parse(r, filepath.Join(home, ".ssh"), block{}, 0); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ParseFile adds the blocks of the named file to c, as parse does. A
+// missing file adds nothing.
+func (c *Config) parseFile(name string, within block, depth int) error {
+	f, err := os.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := c.parse(f, filepath.Dir(name), within, depth); err != nil {
+		return fmt.Errorf("%s:%v", name, err)
+	}
+	return nil
+}
+
+// Parse adds the blocks read from r to c. They are included by a line
+// of the block within, whose patterns they must match as well, and
+// depth is how deep. Included files are relative to dir.
+func (c *Config) parse(r io.Reader, dir string, within block, depth int) error {
+	s := bufio.NewScanner(r)
+	for lineno := 1; s.Scan(); lineno++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		key, rest := line, ""
+		if i := strings.IndexAny(line, " \t="); i >= 0 {
+			key, rest = line[:i], strings.TrimSpace(line[i:])
+			rest = strings.TrimSpace(strings.TrimPrefix(rest, "="))
+		}
+		args, err := split(rest)
+		if err != nil {
+			return fmt.Errorf("%d: %v", lineno, err)
+		}
+		key = strings.ToLower(key)
+		switch key {
+		case "host":
+			if len(args) == 0 {
+				return fmt.Errorf("%d: host needs a pattern", lineno)
+			}
+			patterns := append(within.patterns[:len(within.patterns):len(within.patterns)], args)
+			c.blocks = append(c.blocks, block{patterns: patterns, match: within.match})
+		case "match":
+			c.blocks = append(c.blocks, block{match: true})
+		case "include":
+			if depth >= maxDepth {
+				return fmt.Errorf("%d: includes nested too deeply", lineno)
+			}
+			cur := c.blocks[len(c.blocks)-1]
+			cur.settings = nil
+			for _, pattern := range args {
+				if err := c.include(pattern, dir, cur, depth+1); err != nil {
+					return fmt.Errorf("%d: %v", lineno, err)
+				}
+			}
+			// The lines after the Include line are in the same
+			// block as those before it.
+			c.blocks = append(c.blocks, cur)
+		default:
+			b := &c.blocks[len(c.blocks)-1]
+			b.settings = append(b.settings, setting{key, args})
+		}
+	}
+	return s.Err()
+}
+
+// Include adds the blocks of the files matching the glob pattern, with
+// a leading ~ standing for the home directory, and relative to dir.
+// The files are included by a line of the block within.
+func (c *Config) include(pattern, dir string, within block, depth int) error {
+	if strings.HasPrefix(pattern, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return err
+		}
+		pattern = filepath.Join(home, pattern[2:])
+	} else if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(dir, pattern)
+	}
+	names, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		// The settings before the first Host line of the file are
+		// in the including block.
+		c.blocks = append(c.blocks, within)
+		if err := c.parseFile(name, within, depth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Split splits s into white space separated words, honoring double
+// quotes.
+func split(s string) ([]string, error) {
+	var args []string
+	var w strings.Builder
+	inword, quoted := false, false
+	for _, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			inword = true
+		case !quoted && (r == ' ' || r == '\t'):
+			if inword {
+				args = append(args, w.String())
+				w.Reset()
+				inword = false
+			}
+		default:
+			w.WriteRune(r)
+			inword = true
+		}
+	}
+	if quoted {
+		return nil, errors.New("unterminated quote")
+	}
+	if inword {
+		args = append(args, w.String())
+	}
+	return args, nil
+}
+
+// Get returns the arguments of key for host, or nil if key is not
+// set. Like in ssh(1), the first value found wins.
+func (c *Config) Get(host, key string) []string {
+	if all := c.GetAll(host, key); len(all) > 0 {
+		return all[0]
+	}
+	return nil
+}
+
+// GetAll returns the arguments of every setting of key that applies
+// to host, in order, for keywords like IdentityFile that may be given
+// more than once.
+func (c *Config) GetAll(host, key string) [][]string {
+	key = strings.ToLower(key)
+	var all [][]string
+	for _, b := range c.blocks {
+		if !b.matches(host) {
+			continue
+		}
+		for _, s := range b.settings {
+			if s.key == key {
+				all = append(all, s.args)
+			}
+		}
+	}
+	return all
+}
+
+// Keys returns the keywords used in the configuration, in lower case,
+// whichever host they apply to.
+func (c *Config) Keys() []string {
+	var keys []string
+	seen := make(map[string]bool)
+	for _, b := range c.blocks {
+		for _, s := range b.settings {
+			if !seen[s.key] {
+				seen[s.key] = true
+				keys = append(keys, s.key)
+			}
+		}
+	}
+	return keys
+}
+
+// Matches reports whether the settings of b apply to host, which must
+// match all of its pattern lists.
+func (b *block) matches(host string) bool {
+	if b.match {
+		return false
+	}
+	for _, p := range b.patterns {
+		if !Match(p, host) {
+			return false
+		}
+	}
+	return true
+}
+
+// Match reports whether host matches the pattern list: it must match
+// at least one pattern, and none of the negated ones, which start with
+// '!'. Patterns may contain the wildcards '*' and '?'.
+func Match(patterns []string, host string) bool {
+	ok := false
+	for _, p := range patterns {
+		if strings.HasPrefix(p, "!") {
+			if wildmatch(p[1:], host) {
+				return false
+			}
+		} else if wildmatch(p, host) {
+			ok = true
+		}
+	}
+	return ok
+}
+
+// Wildmatch matches s against pattern, where '*' matches any string
+// and '?' any character.
+func wildmatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if wildmatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return len(s) == 0
+}
@@ -0,0 +1,168 @@
+package sshconfig
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		patterns string
+		host     string
+		want     bool
+	}{
+		{"devbox", "devbox", true},
+		{"devbox", "devbox2", false},
+		{"*", "anything", true},
+		{"dev*", "devbox", true},
+		{"dev*", "dev", true},
+		{"*.example.org", "a.example.org", true},
+		{"*.example.org", "example.org", false},
+		{"dev?", "dev1", true},
+		{"dev?", "dev", false},
+		{"dev?", "dev12", false},
+		{"a b", "b", true},
+		{"* !devbox", "devbox", false},
+		{"* !devbox", "other", true},
+		{"!devbox *", "devbox", false},
+		{"!devbox", "other", false}, // nothing to match
+		{"*.example.org !build*", "build1.example.org", false},
+		{"*.example.org !build*", "web.example.org", true},
+	}
+	for _, tt := range tests {
+		if got := Match(strings.Fields(tt.patterns), tt.host); got != tt.want {
+			t.Errorf("Match(%q, %q) = %v, want %v", tt.patterns, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestGet(t *testing.T) {
+	c, err := Parse(strings.NewReader(`# defaults first
+User glenda
+
+Host devbox
+	HostName devbox.example.org
+	Port=2222
+	IdentityFile ~/.ssh/devbox
+
+Host dev* !dev2
+	HostName wildcard.example.org
+	ProxyJump jump1,jump2:2200
+	IdentityFile ~/.ssh/dev
+
+Match host devbox
+	User nobody
+
+Host *
+	IDENTITYFILE "~/.ssh/my key"
+	User ignored
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host, key string
+		want      []string
+	}{
+		{"devbox", "User", []string{"glenda"}},
+		{"devbox", "HostName", []string{"devbox.example.org"}},
+		{"devbox", "hostname", []string{"devbox.example.org"}},
+		{"devbox", "Port", []string{"2222"}},
+		{"devbox", "ProxyJump", []string{"jump1,jump2:2200"}},
+		{"dev1", "HostName", []string{"wildcard.example.org"}},
+		{"dev2", "HostName", nil},
+		{"dev2", "ProxyJump", nil},
+		{"other", "Port", nil},
+	}
+	for _, tt := range tests {
+		if got := c.Get(tt.host, tt.key); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Get(%q, %q) = %q, want %q", tt.host, tt.key, got, tt.want)
+		}
+	}
+	want := [][]string{{"~/.ssh/devbox"}, {"~/.ssh/dev"}, {"~/.ssh/my key"}}
+	if got := c.GetAll("devbox", "IdentityFile"); !reflect.DeepEqual(got, want) {
+		t.Errorf("GetAll(devbox, IdentityFile) = %q, want %q", got, want)
+	}
+	if got, want := c.Keys(), []string{"user", "hostname", "port", "identityfile", "proxyjump"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Keys() = %q, want %q", got, want)
+	}
+}
+
+func TestInclude(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, s string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("config", `Include conf.d/*.conf missing
+Host devbox
+	Include devbox.conf
+	User devbox-user
+Host *
+	Port 22
+`)
+	write("conf.d/a.conf", `Host build*
+	User builder
+	Port 2201
+`)
+	write("conf.d/b.conf", `Host build2
+	Port 2202
+	HostName b.example.org
+`)
+	// Included in the devbox block: the leading settings apply to
+	// devbox only, and so do those of its Host blocks.
+	write("devbox.conf", `HostName devbox.example.org
+Host *
+	Port 2222
+`)
+	write("loop", "Include loop\n")
+
+	c, err := ParseFile(filepath.Join(dir, "config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host, key string
+		want      string
+	}{
+		{"build2", "User", "builder"},
+		{"build2", "Port", "2201"},
+		{"build2", "HostName", "b.example.org"},
+		{"devbox", "HostName", "devbox.example.org"},
+		{"devbox", "Port", "2222"},
+		{"devbox", "User", "devbox-user"},
+		{"other", "HostName", ""},
+		{"other", "Port", "22"},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(c.Get(tt.host, tt.key), " "); got != tt.want {
+			t.Errorf("Get(%q, %q) = %q, want %q", tt.host, tt.key, got, tt.want)
+		}
+	}
+
+	if _, err := ParseFile(filepath.Join(dir, "loop")); err == nil {
+		t.Error("no error for an Include loop")
+	}
+	if c, err := ParseFile(filepath.Join(dir, "none")); err != nil || len(c.Keys()) != 0 {
+		t.Errorf("missing file: %q, %v", c.Keys(), err)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, s := range []string{
+		"Host\n",
+		`User "glenda` + "\n",
+	} {
+		if _, err := Parse(strings.NewReader(s)); err == nil {
+			t.Errorf("Parse(%q): no error", s)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A profile describes the environment of the shell.
+type profile struct {
+	shell string   // shell to run instead of $SHELL
+	login []string // arguments for an interactive login shell
+	env   []string // NAME=value pairs, values not yet expanded
+	path  []string // directories appended to PATH, not yet expanded
+}
+
+// DefaultProfile returns the name of the default profile file,
+// $XDG_CONFIG_HOME/plan9-shell, or $HOME/.config/plan9-shell.
+func defaultProfile() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		dir = filepath.Join(os.Getenv("HOME"), ".config")
+	}
+	return filepath.Join(dir, "plan9-shell")
+}
+
+// ReadProfile reads the named profile file, keeping the settings that
+// apply to host. A missing file is an empty profile.
+func readProfile(name, host string) (*profile, error) {
+	f, err := os.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return new(profile), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	p, err := parseProfile(f, host)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%v", name, err)
+	}
+	return p, nil
+}
+
+// ParseProfile parses a profile. Every line holds a keyword followed
+// by its arguments; blank lines and lines starting with # are ignored.
+// The keywords are:
+//
+//	shell prog       run prog instead of $SHELL
+//	login arg...     start interactive shells with these arguments
+//	env NAME=value   set the environment variable NAME
+//	path dir...      append the directories to PATH
+//	host pattern...  start a block
+//
+// Settings before the first host line apply to all hosts, settings
+// in a host block apply only if one of the patterns, as understood
+// by filepath.Match, matches host. Later settings override earlier
+// ones. Values may refer to environment variables, like $PLAN9/bin;
+// they are expanded when the shell starts.
+func parseProfile(r io.Reader, host string) (*profile, error) {
+	p := new(profile)
+	match := true
+	s := bufio.NewScanner(r)
+	for lineno := 1; s.Scan(); lineno++ {
+		f := strings.Fields(s.Text())
+		if len(f) == 0 || strings.HasPrefix(f[0], "#") {
+			continue
+		}
+		key, args := f[0], f[1:]
+		if key == "host" {
+			if len(args) == 0 {
+				return nil, fmt.Errorf("%d: host needs a pattern", lineno)
+			}
+			match = false
+			for _, pat := range args {
+				ok, err := filepath.Match(pat, host)
+				if err != nil {
+					return nil, fmt.Errorf("%d: %v", lineno, err)
+				}
+				match = match || ok
+			}
+			continue
+		}
+		switch key {
+		case "shell", "env":
+			if len(args) != 1 {
+				return nil, fmt.Errorf("%d: %s needs one argument", lineno, key)
+			}
+		case "path", "login":
+			if len(args) == 0 {
+				return nil, fmt.Errorf("%d: %s needs an argument", lineno, key)
+			}
+		default:
+			return nil, fmt.Errorf("%d: unknown keyword %q", lineno, key)
+		}
+		if !match {
+			continue
+		}
+		switch key {
+		case "shell":
+			p.shell = args[0]
+		case "env":
+			if !strings.Contains(args[0], "=") {
+				return nil, fmt.Errorf("%d: expected NAME=value", lineno)
+			}
+			p.env = append(p.env, args[0])
+		case "path":
+			p.path = append(p.path, args...)
+		case "login":
+			p.login = args
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Apply returns env amended with the profile's settings.
+func (p *profile) apply(env []string) []string {
+	for _, kv := range p.env {
+		k, v, _ := strings.Cut(kv, "=")
+		env = append(env, k+"="+expand(v, env))
+	}
+	if len(p.path) > 0 {
+		path := getenv(env, "PATH")
+		for _, dir := range p.path {
+			dir = expand(dir, env)
+			if path == "" {
+				path = dir
+			} else {
+				path += string(filepath.ListSeparator) + dir
+			}
+		}
+		env = append(env, "PATH="+path)
+	}
+	return env
+}
+
+// Getenv is like os.Getenv, but looks in env. Later entries take
+// precedence, like in exec.Cmd.
+func getenv(env []string, key string) string {
+	for i := len(env) - 1; i >= 0; i-- {
+		if k, v, _ := strings.Cut(env[i], "="); k == key {
+			return v
+		}
+	}
+	return ""
+}
+
+// Expand replaces $VAR and ${VAR} in s according to env.
+func expand(s string, env []string) string {
+	return os.Expand(s, func(key string) string {
+		return getenv(env, key)
+	})
+}
+
+// LookPath is like exec.LookPath, but searches the directories in
+// path rather than in the PATH of the current process.
+func lookPath(file, path string) (string, error) {
+	if strings.Contains(file, "/") {
+		return file, nil
+	}
+	for _, dir := range filepath.SplitList(path) {
+		if dir == "" {
+			dir = "."
+		}
+		name := filepath.Join(dir, file)
+		if fi, err := os.Stat(name); err == nil && !fi.IsDir() && fi.Mode()&0111 != 0 {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("%s: executable file not found in $PATH", file)
+}
@@ -0,0 +1,102 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseProfile(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want profile
+	}{
+		{"empty", "", profile{}},
+		{"comments and blank lines", `# a comment
+
+	# an indented comment
+shell rc
+
+#shell sh
+`, profile{shell: "rc"}},
+		{"all keywords", `shell $PLAN9/bin/rc
+login -l -i
+env PLAN9=/usr/local/plan9
+env font=$PLAN9/font/lucsans/euro.8.font
+path $PLAN9/bin
+path /a /b
+`, profile{
+			shell: "$PLAN9/bin/rc",
+			login: []string{"-l", "-i"},
+			env:   []string{"PLAN9=/usr/local/plan9", "font=$PLAN9/font/lucsans/euro.8.font"},
+			path:  []string{"$PLAN9/bin", "/a", "/b"},
+		}},
+		{"later settings override", "shell sh\nlogin -l\nshell rc\nlogin -i\n", profile{
+			shell: "rc",
+			login: []string{"-i"},
+		}},
+		// Quotes have no special meaning; they are part of the value,
+		// and don't keep blanks from splitting it.
+		{"quoted values", `env PROMPT='%'
+shell "rc"
+path '$HOME/bin'
+`, profile{
+			shell: `"rc"`,
+			env:   []string{"PROMPT='%'"},
+			path:  []string{"'$HOME/bin'"},
+		}},
+		{"host blocks", `shell sh
+host other *.example.org
+	shell rc
+	env A=1
+host devbox
+	path /devbox
+host dev* !none
+	login -l
+`, profile{
+			shell: "sh",
+			login: []string{"-l"},
+			path:  []string{"/devbox"},
+		}},
+	}
+	for _, tt := range tests {
+		p, err := parseProfile(strings.NewReader(tt.in), "devbox")
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(*p, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, *p, tt.want)
+		}
+	}
+}
+
+func TestParseProfileErrors(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"shell\n", "1: shell needs one argument"},
+		{"shell rc sh\n", "1: shell needs one argument"},
+		{"env A=1 B=2\n", "1: env needs one argument"},
+		{`env PROMPT="% "` + "\n", "1: env needs one argument"},
+		{"env A\n", "1: expected NAME=value"},
+		{"path\n", "1: path needs an argument"},
+		{"login\n", "1: login needs an argument"},
+		{"# comment\n\nhost\n", "3: host needs a pattern"},
+		{"host [\n", "1: syntax error in pattern"},
+		{"shell rc\nsetenv A=1\n", `2: unknown keyword "setenv"`},
+		// Malformed lines are errors even in blocks that don't apply.
+		{"host other\n\tshell\n", "2: shell needs one argument"},
+		{"host other\n\tbogus\n", `2: unknown keyword "bogus"`},
+	}
+	for _, tt := range tests {
+		_, err := parseProfile(strings.NewReader(tt.in), "devbox")
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("parseProfile(%q): error %v, want %q", tt.in, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"mgk.ro/cmd/plan9/internal/rundir"
+	"mgk.ro/net/netutil"
+)
+
+// SessionDir returns the directory of the named session, creating it
+// if needed.
+func sessionDir(name string) (string, error) {
+	if name == "." || name == ".." || strings.Contains(name, "/") {
+		return "", fmt.Errorf("invalid session name %q", name)
+	}
+	rdir, err := rundir.Dir("plan9-shell")
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(rdir, "sessions", name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// LinkServer points the session's link for the named service at the
+// unix domain socket in addr, and returns the address of the link.
+// Other addresses are returned unchanged.
+func linkServer(dir, name, addr string) (string, error) {
+	net, path, err := netutil.SplitDialString(addr)
+	if err != nil {
+		return "", err
+	}
+	if net != "unix" {
+		return addr, nil
+	}
+	link := filepath.Join(dir, name)
+	if err := relink(path, link); err != nil {
+		return "", err
+	}
+	return "unix!" + link, nil
+}
+
+// Relink atomically makes link a symbolic link to target.
+func relink(target, link string) error {
+	tmp := link + ".new"
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, link)
+}
+
+// RunSession runs shell in the session named by -S, unless the session
+// is already running, and waits until the session ends, or until the
+// connection is gone. It returns the exit status to report.
+//
+// A session is running while the lock file in its directory is
+// locked. The lock is inherited by the shell and by the programs it
+// starts, so the session ends when the last of them exits.
+func runSession(shell *exec.Cmd) int {
+	dir, err := sessionDir(*sessionName)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	lockfile := filepath.Join(dir, "lock")
+	lock, err := os.OpenFile(lockfile, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	done := make(chan error, 1)
+	if syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) == nil {
+		err := startSession(shell, dir, lock, done)
+		lock.Close()
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+	} else {
+		lock.Close()
+		log.Printf("reattached to session %s", *sessionName)
+	}
+
+	ended := make(chan bool, 1)
+	go func() {
+		if f, err := os.Open(lockfile); err == nil {
+			syscall.Flock(int(f.Fd()), syscall.LOCK_SH)
+		}
+		ended <- true
+	}()
+	gone := make(chan bool, 1)
+	go func() {
+		io.Copy(io.Discard, os.Stdin)
+		gone <- true
+	}()
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGHUP, syscall.SIGTERM)
+	defer signal.Stop(sigc)
+
+	select {
+	case <-ended:
+		os.RemoveAll(dir)
+		select {
+		case err := <-done:
+			return status(err)
+		default:
+			return 0
+		}
+	case <-gone:
+	case <-sigc:
+	}
+	return 0
+}
+
+// StartSession starts shell detached from the connection, passing it
+// the locked lock file, with its output going to the session log.
+func startSession(shell *exec.Cmd, dir string, lock *os.File, done chan<- error) error {
+	out, err := os.OpenFile(filepath.Join(dir, "log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	shell.Stdin = nil
+	shell.Stdout = out
+	shell.Stderr = out
+	shell.ExtraFiles = []*os.File{lock}
+	shell.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := shell.Start(); err != nil {
+		return err
+	}
+	go func() {
+		done <- shell.Wait()
+	}()
+	return nil
+}
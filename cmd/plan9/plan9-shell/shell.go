@@ -1,11 +1,67 @@
+//go:build !windows && !plan9
+
 /*
 plan9-shell: Unix shell wrapper
-	plan9-shell -addr addr [-c cmd]
+	plan9-shell -addr addr [-s service=addr ...] [-n name=path ...]
+		[-f profile] [-shell prog] [-S session] [-c cmd]
 
 This tool wraps the user's SHELL and sets some variables useful to
 plan9port programs. It will set DEVDRAW_SERVER=addr, and
-DEVDRAW=devdraw-proxy. If -c is present, rather than start an
-interactive shell, it will pass cmd to the user's shell to execute.
+DEVDRAW=devdraw-proxy. Every -s option sets SERVICE_SERVER=addr,
+where SERVICE is the upper-cased service name, for devdraw-proxy -s
+service to find; -s devdraw=addr is the same as -addr addr.
+
+The forwarded unix domain sockets, which must belong to the user, are
+moved into the private directory $XDG_RUNTIME_DIR/plan9-shell, or
+$TMPDIR/plan9-shell.uid if XDG_RUNTIME_DIR is not set, after removing
+stale sockets left there by crashed sessions. If that directory is on
+another file system, a private directory next to the sockets is used
+instead.
+
+If any -n options are given, a private plan9port name space
+directory is created and NAMESPACE is set to it. For each -n option,
+the name space entry name refers to the unix domain socket at path,
+usually a local name space socket like plumb forwarded by plan9-ssh.
+The directory is removed on exit.
+
+If -c is present, rather than start an interactive shell, it will pass
+cmd to the user's shell to execute.
+
+With -S, cmd runs in the persistent session name, detached from the
+connection. If the session is already running, cmd is not run again;
+instead, the session is pointed at the new sockets. Either way,
+plan9-shell waits until the session ends, or until its standard
+input is closed, which plan9-ssh takes to mean the connection is
+gone. The variables above refer to links in the session directory
+that always lead to the latest sockets, NAMESPACE is the same for
+the whole session, and PLAN9_SESSION is set to name, which makes
+devdraw-proxy reconnect when it loses its server. The output of the
+session goes to a log file in the session directory.
+
+Further variables, PATH additions, and the shell to use instead of
+SHELL are read from the profile file given by -f, by default
+$XDG_CONFIG_HOME/plan9-shell or $HOME/.config/plan9-shell, for
+example:
+
+	# plan9port everywhere
+	env PLAN9=/usr/local/plan9
+	path $PLAN9/bin
+	shell rc
+
+	host build*
+		env PLAN9=$HOME/plan9
+		shell bash
+
+Settings in a host block apply only on hosts matching one of its
+patterns. Later settings override earlier ones. The -shell option
+overrides the shell of the profile.
+
+Interactive shells are started as login shells. Plan 9 rc and fish
+are given -l, other shells get a '-' prepended to their argv[0], as
+login(1) does; the profile keyword login overrides the arguments,
+for example "login -l -i". Commands are run with -c. The plan9port
+rc needs PLAN9 to find rcmain; if it's not set, it is set to the
+plan9port tree rc was found in.
 
 This program is not intended to be called by the user, but by
 plan9-ssh.
@@ -13,27 +69,67 @@ plan9-ssh.
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
 
-	"mgk.ro/net/netutil"
+	"mgk.ro/cmd/plan9/internal/rundir"
+	"mgk.ro/cmd/plan9/internal/service"
 	_ "mgk.ro/log"
+	"mgk.ro/net/netutil"
 )
 
 var addr = flag.String("addr", "", "network address of the drawterm server")
 var cmd = flag.String("c", "", "shell command to execute")
+var servers = make(pairFlag)
+var exports = make(pairFlag)
+var profileFile = flag.String("f", defaultProfile(), "profile `file`")
+var sessionName = flag.String("S", "", "run cmd in the persistent session `name`")
+var shellProg = flag.String("shell", "", "run `prog` instead of the profile's shell or SHELL")
 
-var usageString = `usage: plan9-shell -addr addr [-c cmd]
+func init() {
+	flag.Var(servers, "s", "`service=addr` of a forwarded service; may be repeated")
+	flag.Var(exports, "n", "`name=path` of a forwarded name space socket; may be repeated")
+}
+
+var usageString = `usage: plan9-shell -addr addr [-s service=addr ...] [-n name=path ...]
+	[-f profile] [-shell prog] [-S session] [-c cmd]
 Options:
 `
 
+// A pairFlag collects key=value arguments.
+type pairFlag map[string]string
+
+func (f pairFlag) String() string {
+	var ss []string
+	for name, addr := range f {
+		ss = append(ss, name+"="+addr)
+	}
+	sort.Strings(ss)
+	return strings.Join(ss, " ")
+}
+
+func (f pairFlag) Set(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	if !ok || k == "" || v == "" {
+		return errors.New("expected key=value")
+	}
+	f[k] = v
+	return nil
+}
+
 func usage() {
 	fmt.Fprint(os.Stderr, usageString)
 	flag.PrintDefaults()
+	cleanupAll()
 	os.Exit(1)
 }
 
@@ -41,34 +137,208 @@ func main() {
 	flag.Usage = usage
 	flag.Parse()
 
-	if *addr == "" {
+	if *addr != "" {
+		servers["devdraw"] = *addr
+	}
+	if len(servers) == 0 || *sessionName != "" && *cmd == "" {
 		usage()
 	}
-	defer cleanup(*addr)
-
-	shell := exec.Command(os.Getenv("SHELL"))
-	shell.Env = append(os.Environ(),
-		fmt.Sprintf("DEVDRAW_SERVER=%s", *addr),
-		"DEVDRAW=devdraw-proxy",
-	)
-	if *cmd == "" {
-		shell.Args[0] = "-" + filepath.Base(shell.Args[0])
+	if err := adoptAll(); err != nil {
+		cleanupAll()
+		log.Fatal(err)
+	}
+	shell, err := command()
+	if err != nil {
+		cleanupAll()
+		log.Fatal(err)
+	}
+	var status int
+	if *sessionName != "" {
+		status = runSession(shell)
 	} else {
-		shell.Args = append(shell.Args, "-c", *cmd)
+		status = run(shell)
+	}
+	cleanupAll()
+	os.Exit(status)
+}
+
+// Command returns the shell command to run.
+func command() (*exec.Cmd, error) {
+	for name := range servers {
+		if _, ok := service.Lookup(name); !ok {
+			return nil, fmt.Errorf("unknown service %q", name)
+		}
+	}
+	host, _ := os.Hostname()
+	prof, err := readProfile(*profileFile, host)
+	if err != nil {
+		return nil, err
+	}
+	var sess string
+	if *sessionName != "" {
+		if sess, err = sessionDir(*sessionName); err != nil {
+			return nil, err
+		}
+	}
+
+	shell := new(exec.Cmd)
+	shell.Env = os.Environ()
+	for name, addr := range servers {
+		if sess != "" {
+			if addr, err = linkServer(sess, name, addr); err != nil {
+				return nil, err
+			}
+		}
+		shell.Env = append(shell.Env, fmt.Sprintf("%s=%s", service.ServerVar(name), addr))
+	}
+	if _, ok := servers["devdraw"]; ok {
+		shell.Env = append(shell.Env, "DEVDRAW=devdraw-proxy")
+	}
+	if len(exports) > 0 || sess != "" {
+		var nsdir string
+		if sess != "" {
+			nsdir = filepath.Join(sess, "ns")
+		}
+		ns, err := mkns(nsdir, exports)
+		if err != nil {
+			return nil, err
+		}
+		shell.Env = append(shell.Env, fmt.Sprintf("NAMESPACE=%s", ns))
+	}
+	if sess != "" {
+		shell.Env = append(shell.Env, fmt.Sprintf("PLAN9_SESSION=%s", *sessionName))
+	}
+	shell.Env = prof.apply(shell.Env)
+	sh := *shellProg
+	if sh == "" {
+		sh = prof.shell
+	}
+	if sh == "" {
+		sh = getenv(shell.Env, "SHELL")
+	}
+	// Look in the new PATH, so the profile can add the shell's
+	// directory, like $PLAN9/bin for rc.
+	shell.Path, err = lookPath(sh, getenv(shell.Env, "PATH"))
+	if err != nil {
+		return nil, err
+	}
+	shell.Args = shellArgs(shell.Path, *cmd, prof.login)
+	shell.Env = append(shell.Env, "SHELL="+shell.Path)
+	if shellName(shell.Path) == "rc" {
+		shell.Env = rcEnv(shell.Path, shell.Env)
 	}
 	shell.Stdin = os.Stdin
 	shell.Stdout = os.Stdout
 	shell.Stderr = os.Stderr
-	if err := shell.Run(); err != nil {
-		cleanup(*addr)
-		// If the process starts, but returns an error, propagate
-		// it further without logging.
-		if err, ok := err.(*exec.ExitError); ok {
-			// By exiting with the error code from the shell,
-			// we pass it further to our caller (usually ssh(1)).
-			os.Exit(err.ProcessState.ExitCode())
+	return shell, nil
+}
+
+// AdoptAll moves the forwarded sockets into our private directory,
+// after cleaning it of stale sockets.
+func adoptAll() error {
+	dir, err := rundir.Dir("plan9-shell")
+	if err != nil {
+		return err
+	}
+	rundir.Clean(dir)
+	for name, addr := range servers {
+		net, path, err := netutil.SplitDialString(addr)
+		if err != nil {
+			return err
 		}
-		log.Fatal(err)
+		if net != "unix" {
+			continue
+		}
+		if path, err = adopt(dir, path); err != nil {
+			return err
+		}
+		servers[name] = "unix!" + path
+	}
+	for name, path := range exports {
+		if path, err = adopt(dir, path); err != nil {
+			return err
+		}
+		exports[name] = path
+	}
+	return nil
+}
+
+// Cleaned records the fallback directories already cleaned, so that
+// sockets adopted earlier are not probed.
+var cleaned = make(map[string]bool)
+
+// Adopt moves the socket at path, which must be ours, into dir, or,
+// if dir is on another file system, into a private directory next to
+// the socket. It returns the new name of the socket.
+func adopt(dir, path string) (string, error) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return "", err
+	}
+	if fi.Mode()&fs.ModeSocket == 0 || !rundir.Owned(fi) {
+		return "", fmt.Errorf("%s: not a socket owned by us", path)
+	}
+	newpath := filepath.Join(dir, filepath.Base(path))
+	err = os.Rename(path, newpath)
+	if errors.Is(err, syscall.EXDEV) {
+		if dir, err = rundir.DirIn(filepath.Dir(path), "plan9-shell"); err != nil {
+			return "", err
+		}
+		if !cleaned[dir] {
+			rundir.Clean(dir)
+			cleaned[dir] = true
+		}
+		newpath = filepath.Join(dir, filepath.Base(path))
+		err = os.Rename(path, newpath)
+	}
+	if err != nil {
+		return "", err
+	}
+	return newpath, nil
+}
+
+// Nsdir is the temporary name space directory, if any.
+var nsdir string
+
+// Mkns populates the name space directory dir with an entry for each
+// of the exported sockets, and returns its name. If dir is "", a
+// temporary directory is created, and removed by cleanupAll.
+func mkns(dir string, exports map[string]string) (string, error) {
+	if dir == "" {
+		rdir, err := rundir.Dir("plan9-shell")
+		if err != nil {
+			return "", err
+		}
+		tmp, err := os.MkdirTemp(rdir, "ns.")
+		if err != nil {
+			return "", err
+		}
+		dir, nsdir = tmp, tmp
+	} else if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	for name, path := range exports {
+		if strings.Contains(name, "/") {
+			return "", fmt.Errorf("invalid name space entry %q", name)
+		}
+		if err := relink(path, filepath.Join(dir, name)); err != nil {
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// CleanupAll removes the sockets of all forwarded services and name
+// space entries, and the private name space directory.
+func cleanupAll() {
+	for _, addr := range servers {
+		cleanup(addr)
+	}
+	for _, path := range exports {
+		os.Remove(path)
+	}
+	if nsdir != "" {
+		os.RemoveAll(nsdir)
 	}
 }
 
@@ -0,0 +1,70 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LoginArgs maps shell names to the arguments that make them
+// interactive login shells. Shells not listed here are told by
+// prefixing their argv[0] with '-', which works for sh, bash, dash,
+// ksh, zsh, tcsh, and the like.
+var loginArgs = map[string][]string{
+	"rc":   {"-l"},
+	"fish": {"-l"},
+}
+
+// ShellName returns the name of the shell at path, looking through
+// symbolic links if the name itself is not known, so that for example
+// /bin/sh can be found to be dash.
+func shellName(path string) string {
+	name := strings.TrimPrefix(filepath.Base(path), "-")
+	if _, ok := loginArgs[name]; ok {
+		return name
+	}
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		if n := filepath.Base(real); loginArgs[n] != nil {
+			return n
+		}
+	}
+	return name
+}
+
+// ShellArgs returns the argument list, argv[0] included, that starts
+// the shell at path as an interactive login shell, or runs cmd if it's
+// not "". If login is not nil, it is used instead of the known login
+// arguments of the shell.
+func shellArgs(path, cmd string, login []string) []string {
+	if cmd != "" {
+		// Every shell we know of takes -c.
+		return []string{path, "-c", cmd}
+	}
+	if login == nil {
+		login = loginArgs[shellName(path)]
+	}
+	if login == nil {
+		return []string{"-" + filepath.Base(path)}
+	}
+	return append([]string{path}, login...)
+}
+
+// RcEnv returns env amended, if needed, so that the plan9port rc at
+// path finds rcmain, which it looks for in $PLAN9. If PLAN9 is not
+// set, the root of the installation rc comes from is used, when it
+// has an rcmain.
+func rcEnv(path string, env []string) []string {
+	if getenv(env, "PLAN9") != "" {
+		return env
+	}
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		path = real
+	}
+	root := filepath.Dir(filepath.Dir(path))
+	if _, err := os.Stat(filepath.Join(root, "rcmain")); err != nil {
+		return env
+	}
+	return append(env, "PLAN9="+root)
+}
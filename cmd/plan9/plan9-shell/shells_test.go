@@ -0,0 +1,114 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// A fake shell prints its arguments, after argv[0], and $PLAN9.
+const fakeShellScript = "#!/bin/sh\necho \"$*|$PLAN9\"\n"
+
+// MkShells builds a tree of fake shells in dir:
+//
+//	bin/sh, bin/fish        fake shells
+//	bin/login -> ../real/bash
+//	bin/shell -> ../plan9/bin/rc
+//	plan9/bin/rc, plan9/rcmain
+func mkShells(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, d := range []string{"bin", "real", "plan9/bin"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{"bin/sh", "bin/fish", "real/bash", "plan9/bin/rc"} {
+		if err := os.WriteFile(filepath.Join(dir, f), []byte(fakeShellScript), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "plan9/rcmain"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"bin/login": "../real/bash",
+		"bin/shell": "../plan9/bin/rc",
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(dir, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestShells(t *testing.T) {
+	dir := mkShells(t)
+	plan9 := filepath.Join(dir, "plan9")
+	tests := []struct {
+		shell string   // relative to dir
+		cmd   string   // -c
+		login []string // from the profile
+		name  string   // from shellName
+		argv  []string // argv[0] relative to dir, if it's a path
+		out   string   // printed by the fake shell
+	}{
+		{"bin/sh", "", nil, "sh", []string{"-sh"}, "|"},
+		{"bin/login", "", nil, "login", []string{"-login"}, "|"},
+		{"real/bash", "", nil, "bash", []string{"-bash"}, "|"},
+		{"bin/fish", "", nil, "fish", []string{"bin/fish", "-l"}, "-l|"},
+		{"plan9/bin/rc", "", nil, "rc", []string{"plan9/bin/rc", "-l"}, "-l|" + plan9},
+		{"bin/shell", "", nil, "rc", []string{"bin/shell", "-l"}, "-l|" + plan9},
+		{"bin/sh", "", []string{"-i", "--norc"}, "sh", []string{"bin/sh", "-i", "--norc"}, "-i --norc|"},
+		{"bin/fish", "", []string{"-i"}, "fish", []string{"bin/fish", "-i"}, "-i|"},
+		{"bin/sh", "echo hi", []string{"-i"}, "sh", []string{"bin/sh", "-c", "echo hi"}, "-c echo hi|"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.shell)
+		if name := shellName(path); name != tt.name {
+			t.Errorf("shellName(%s) = %q, want %q", tt.shell, name, tt.name)
+		}
+		argv := shellArgs(path, tt.cmd, tt.login)
+		want := append([]string(nil), tt.argv...)
+		if strings.Contains(want[0], "/") {
+			want[0] = filepath.Join(dir, want[0])
+		}
+		if !reflect.DeepEqual(argv, want) {
+			t.Errorf("shellArgs(%s, %q, %q) = %q, want %q", tt.shell, tt.cmd, tt.login, argv, want)
+			continue
+		}
+
+		// Run it like plan9-shell does.
+		env := []string{"PATH=/bin:/usr/bin"}
+		if shellName(path) == "rc" {
+			env = rcEnv(path, env)
+		}
+		cmd := &exec.Cmd{Path: path, Args: argv, Env: env}
+		out, err := cmd.Output()
+		if err != nil {
+			t.Errorf("%s: %v", tt.shell, err)
+			continue
+		}
+		if got := strings.TrimSpace(string(out)); got != tt.out {
+			t.Errorf("%s %q: got %q, want %q", tt.shell, argv, got, tt.out)
+		}
+	}
+}
+
+func TestRcEnv(t *testing.T) {
+	dir := mkShells(t)
+	env := []string{"PLAN9=/usr/local/plan9"}
+	if got := rcEnv(filepath.Join(dir, "bin/shell"), env); !reflect.DeepEqual(got, env) {
+		t.Errorf("rcEnv with PLAN9 set = %q, want %q", got, env)
+	}
+	// No rcmain next to rc's tree.
+	if got := rcEnv(filepath.Join(dir, "bin/sh"), nil); got != nil {
+		t.Errorf("rcEnv without rcmain = %q, want nothing", got)
+	}
+}
@@ -0,0 +1,98 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Forwarded lists the signals relayed to the shell's process group.
+var forwarded = []os.Signal{
+	syscall.SIGHUP,
+	syscall.SIGINT,
+	syscall.SIGQUIT,
+	syscall.SIGTERM,
+	syscall.SIGWINCH,
+}
+
+// HangupGrace is how long the shell's process group has to exit after
+// a hangup before it is killed.
+var hangupGrace = 5 * time.Second
+
+// Run runs the shell in its own process group and waits for it,
+// forwarding signals to the whole group, so that no orphans are left
+// behind when the session hangs up. It returns the exit status to
+// report to our caller.
+func run(shell *exec.Cmd) int {
+	shell.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if isctty(os.Stdin) {
+		// Give the shell the terminal, so that it gets keyboard
+		// signals and can do job control.
+		shell.SysProcAttr.Foreground = true
+		shell.SysProcAttr.Ctty = 0 // shell's stdin
+	}
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, forwarded...)
+	defer signal.Stop(sigc)
+
+	if err := shell.Start(); err != nil {
+		log.Print(err)
+		return 1
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- shell.Wait()
+	}()
+	pgid := shell.Process.Pid
+	var kill <-chan time.Time
+	for {
+		select {
+		case sig := <-sigc:
+			syscall.Kill(-pgid, sig.(syscall.Signal))
+			if (sig == syscall.SIGHUP || sig == syscall.SIGTERM) && kill == nil {
+				kill = time.After(hangupGrace)
+			}
+		case <-kill:
+			syscall.Kill(-pgid, syscall.SIGKILL)
+		case err := <-done:
+			return status(err)
+		}
+	}
+}
+
+// Status returns the exit status corresponding to the outcome of the
+// shell.
+func status(err error) int {
+	if err == nil {
+		return 0
+	}
+	// If the process starts, but returns an error, propagate
+	// it further without logging.
+	var exiterr *exec.ExitError
+	if !errors.As(err, &exiterr) {
+		log.Print(err)
+		return 1
+	}
+	// By exiting with the error code from the shell, we pass it
+	// further to our caller (usually ssh(1)). Like shells do, death
+	// by signal n is reported as 128+n.
+	if ws, ok := exiterr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return exiterr.ExitCode()
+}
+
+// Isctty reports whether f is our controlling terminal.
+func isctty(f *os.File) bool {
+	var pgrp int32
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), syscall.TIOCGPGRP, uintptr(unsafe.Pointer(&pgrp)))
+	return errno == 0
+}
@@ -0,0 +1,135 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// FakeShell writes a shell script that sets up traps, tells when it's
+// ready by creating the file ready, and loops. The traps can write to
+// the file out, named by $OUT.
+func fakeShell(t *testing.T, traps string) (cmd *exec.Cmd, out, ready string) {
+	t.Helper()
+	if isctty(os.Stdin) {
+		t.Skip("the shell would take over the terminal")
+	}
+	dir := t.TempDir()
+	out = filepath.Join(dir, "out")
+	ready = filepath.Join(dir, "ready")
+	script := filepath.Join(dir, "shell")
+	body := "#!/bin/sh\n" + traps + "\n: > " + ready + "\nwhile :; do sleep 0.05; done\n"
+	if err := os.WriteFile(script, []byte(body), 0755); err != nil {
+		t.Fatal(err)
+	}
+	cmd = exec.Command(script)
+	cmd.Env = append(os.Environ(), "OUT="+out)
+	return cmd, out, ready
+}
+
+// RunAndSignal runs the shell with run, sends us sig once the shell is
+// ready, and returns the status run returned.
+func runAndSignal(t *testing.T, cmd *exec.Cmd, ready string, sig syscall.Signal) int {
+	t.Helper()
+	statusc := make(chan int, 1)
+	go func() {
+		statusc <- run(cmd)
+	}()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, err := os.Stat(ready); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the shell didn't start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	syscall.Kill(os.Getpid(), sig)
+	select {
+	case status := <-statusc:
+		return status
+	case <-time.After(10 * time.Second):
+		t.Fatal("run didn't return")
+	}
+	return 0
+}
+
+func readOut(t *testing.T, name string) string {
+	t.Helper()
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(b))
+}
+
+func TestRunForwardsSignals(t *testing.T) {
+	tests := []struct {
+		sig    syscall.Signal
+		name   string
+		status int
+	}{
+		{syscall.SIGINT, "INT", 7},
+		{syscall.SIGHUP, "HUP", 5},
+		{syscall.SIGTERM, "TERM", 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sig.String(), func(t *testing.T) {
+			trap := fmt.Sprintf(`trap 'echo %s > "$OUT"; exit %d' %s`, tt.name, tt.status, tt.name)
+			cmd, out, ready := fakeShell(t, trap)
+			status := runAndSignal(t, cmd, ready, tt.sig)
+			if status != tt.status {
+				t.Errorf("status %d, want %d", status, tt.status)
+			}
+			if got := readOut(t, out); got != tt.name {
+				t.Errorf("the shell got %q, want %q", got, tt.name)
+			}
+		})
+	}
+}
+
+// TestRunKillsAfterHangup checks that a shell ignoring the hangup is
+// killed after hangupGrace, and that death by signal n gives 128+n.
+func TestRunKillsAfterHangup(t *testing.T) {
+	defer func(d time.Duration) { hangupGrace = d }(hangupGrace)
+	hangupGrace = 200 * time.Millisecond
+
+	cmd, out, ready := fakeShell(t, `trap 'echo HUP > "$OUT"' HUP`)
+	start := time.Now()
+	status := runAndSignal(t, cmd, ready, syscall.SIGHUP)
+	if want := 128 + int(syscall.SIGKILL); status != want {
+		t.Errorf("status %d, want %d", status, want)
+	}
+	if d := time.Since(start); d < hangupGrace {
+		t.Errorf("killed after %v, before the grace period", d)
+	}
+	if got := readOut(t, out); got != "HUP" {
+		t.Errorf("the shell got %q, want HUP", got)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	tests := []struct {
+		script string
+		status int
+	}{
+		{"exit 0", 0},
+		{"exit 3", 3},
+		{"kill -TERM $$", 128 + int(syscall.SIGTERM)},
+		{"kill -KILL $$", 128 + int(syscall.SIGKILL)},
+	}
+	for _, tt := range tests {
+		err := exec.Command("/bin/sh", "-c", tt.script).Run()
+		if got := status(err); got != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.script, got, tt.status)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// SshArgOpts lists the ssh(1) options that take an argument.
+const sshArgOpts = "BbcDEeFIiJLlmOoPpQRSWw"
+
+// Cmdsplit splits the ssh args into the options followed by the
+// destination, and the command (if any).
+//
+// Options are parsed like ssh(1) does, so option letters may be
+// grouped, arguments may be attached to their option, like -p2222, or
+// be the next argument, and options may appear after the destination.
+// "--" ends the options, and is dropped.
+func cmdsplit(args []string) (params []string, cmd string, err error) {
+	var host string
+	terminated := false
+	i := 0
+	for {
+		for !terminated && i < len(args) {
+			a := args[i]
+			if a == "--" {
+				terminated = true
+				i++
+				break
+			}
+			if len(a) < 2 || a[0] != '-' {
+				break
+			}
+			params = append(params, a)
+			i++
+			for j := 1; j < len(a); j++ {
+				if strings.IndexByte(sshArgOpts, a[j]) < 0 {
+					continue
+				}
+				if j == len(a)-1 {
+					if i == len(args) {
+						return nil, "", fmt.Errorf("option requires an argument -- %c", a[j])
+					}
+					params = append(params, args[i])
+					i++
+				}
+				break
+			}
+		}
+		if host != "" {
+			break
+		}
+		if i == len(args) {
+			return nil, "", errors.New("missing destination")
+		}
+		host = args[i]
+		i++
+	}
+	return append(params, host), strings.Join(args[i:], " "), nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCmdsplit(t *testing.T) {
+	tests := []struct {
+		args   []string
+		params []string
+		cmd    string
+		err    string
+	}{
+		{args: []string{"host"}, params: []string{"host"}},
+		{args: []string{"user@host", "ls", "-l"}, params: []string{"user@host"}, cmd: "ls -l"},
+		{args: []string{"host", "echo", "a b"}, params: []string{"host"}, cmd: "echo a b"},
+		{args: []string{"-p", "2222", "-i", "key", "host", "cmd"}, params: []string{"-p", "2222", "-i", "key", "host"}, cmd: "cmd"},
+		{args: []string{"-o", "Opt=val", "host"}, params: []string{"-o", "Opt=val", "host"}},
+		{args: []string{"-oOpt=val", "host", "cmd"}, params: []string{"-oOpt=val", "host"}, cmd: "cmd"},
+		{args: []string{"-p2222", "host"}, params: []string{"-p2222", "host"}},
+		{args: []string{"-vvi", "key", "host", "cmd"}, params: []string{"-vvi", "key", "host"}, cmd: "cmd"},
+		{args: []string{"-vvikey", "host"}, params: []string{"-vvikey", "host"}},
+		{args: []string{"-A", "-t", "-t", "host"}, params: []string{"-A", "-t", "-t", "host"}},
+		{args: []string{"host", "-l", "user", "cmd"}, params: []string{"-l", "user", "host"}, cmd: "cmd"},
+		{args: []string{"-A", "host", "-p", "22", "ls", "-p"}, params: []string{"-A", "-p", "22", "host"}, cmd: "ls -p"},
+		{args: []string{"-J", "jump", "-L", "8080:localhost:80", "host"}, params: []string{"-J", "jump", "-L", "8080:localhost:80", "host"}},
+		{args: []string{"--", "host", "-l"}, params: []string{"host"}, cmd: "-l"},
+		{args: []string{"-p", "22", "--", "host", "cmd", "-x"}, params: []string{"-p", "22", "host"}, cmd: "cmd -x"},
+		{args: []string{"host", "--", "cmd", "--"}, params: []string{"host"}, cmd: "cmd --"},
+		{args: nil, err: "missing destination"},
+		{args: []string{"-p", "22"}, err: "missing destination"},
+		{args: []string{"--"}, err: "missing destination"},
+		{args: []string{"-p"}, err: "option requires an argument -- p"},
+		{args: []string{"-vvi"}, err: "option requires an argument -- i"},
+		{args: []string{"host", "-l"}, err: "option requires an argument -- l"},
+	}
+	for _, tt := range tests {
+		params, cmd, err := cmdsplit(tt.args)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("cmdsplit(%q): error %v, want %q", tt.args, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("cmdsplit(%q): %v", tt.args, err)
+			continue
+		}
+		if !reflect.DeepEqual(params, tt.params) || cmd != tt.cmd {
+			t.Errorf("cmdsplit(%q) = %q, %q, want %q, %q", tt.args, params, cmd, tt.params, tt.cmd)
+		}
+	}
+}
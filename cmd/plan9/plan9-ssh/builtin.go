@@ -0,0 +1,557 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/term"
+
+	"mgk.ro/cmd/plan9/internal/sshconfig"
+)
+
+// SshOptions are the settings of the built-in client.
+type sshOptions struct {
+	host       string // destination, as given
+	hostname   string // real host name to connect to
+	user       string
+	port       string
+	identities []string
+	knownHosts []string
+	jump       []string // jump hosts, [user@]host[:port]
+	tty        bool     // force a pseudo-terminal, -t
+	notty      bool     // never use a pseudo-terminal, -T
+}
+
+// ParseOptions parses the options and destination returned by cmdsplit,
+// and completes them from the ssh_config(5) files.
+func parseOptions(params []string) (*sshOptions, error) {
+	o := new(sshOptions)
+	over := make(map[string]string) // from -o, which take precedence
+	cfgfile := filepath.Join(home(), ".ssh", "config")
+	dest := params[len(params)-1]
+	params = params[:len(params)-1]
+	for i := 0; i < len(params); i++ {
+		a := params[i]
+		for j := 1; j < len(a); j++ {
+			c := a[j]
+			if strings.IndexByte(sshArgOpts, c) < 0 {
+				switch c {
+				case 't':
+					o.tty = true
+				case 'T':
+					o.notty = true
+				case '4', '6', 'q', 'v', 'C':
+				default:
+					return nil, fmt.Errorf("option -%c not supported by the built-in client", c)
+				}
+				continue
+			}
+			val := a[j+1:]
+			if val == "" {
+				i++
+				val = params[i]
+			}
+			switch c {
+			case 'p':
+				o.port = val
+			case 'l':
+				o.user = val
+			case 'i':
+				o.identities = append(o.identities, val)
+			case 'F':
+				cfgfile = val
+			case 'J':
+				if _, ok := over["proxyjump"]; !ok {
+					over["proxyjump"] = val
+				}
+			case 'o':
+				k, v, ok := strings.Cut(val, "=")
+				if !ok {
+					k, v, _ = strings.Cut(val, " ")
+				}
+				k = strings.ToLower(strings.TrimSpace(k))
+				if _, ok := over[k]; !ok {
+					over[k] = strings.TrimSpace(v)
+				}
+			default:
+				return nil, fmt.Errorf("option -%c not supported by the built-in client", c)
+			}
+			break
+		}
+	}
+	if i := strings.LastIndex(dest, "@"); i >= 0 {
+		if o.user == "" {
+			o.user = dest[:i]
+		}
+		dest = dest[i+1:]
+	}
+	o.host = dest
+
+	var cfgs []*sshconfig.Config
+	for _, name := range []string{cfgfile, "/etc/ssh/ssh_config"} {
+		cfg, err := sshconfig.ParseFile(name)
+		if err != nil {
+			return nil, err
+		}
+		cfgs = append(cfgs, cfg)
+	}
+	// Get returns the first value of key, like ssh(1) does.
+	get := func(key string) string {
+		if v, ok := over[strings.ToLower(key)]; ok {
+			return v
+		}
+		for _, cfg := range cfgs {
+			if v := cfg.Get(o.host, key); len(v) > 0 {
+				return v[0]
+			}
+		}
+		return ""
+	}
+	o.hostname = get("HostName")
+	if o.hostname == "" {
+		o.hostname = o.host
+	}
+	o.hostname = strings.NewReplacer("%h", o.host, "%%", "%").Replace(o.hostname)
+	if o.user == "" {
+		o.user = get("User")
+	}
+	if o.user == "" {
+		o.user = os.Getenv("USER")
+	}
+	if o.port == "" {
+		o.port = get("Port")
+	}
+	if o.port == "" {
+		o.port = "22"
+	}
+	if v, ok := over["identityfile"]; ok {
+		o.identities = append(o.identities, v)
+	}
+	for _, cfg := range cfgs {
+		for _, args := range cfg.GetAll(o.host, "IdentityFile") {
+			o.identities = append(o.identities, args...)
+		}
+	}
+	if len(o.identities) == 0 {
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			o.identities = append(o.identities, filepath.Join("~", ".ssh", name))
+		}
+	}
+	for i, name := range o.identities {
+		o.identities[i] = o.expand(name)
+	}
+	if v := get("UserKnownHostsFile"); v != "" {
+		for _, name := range strings.Fields(v) {
+			o.knownHosts = append(o.knownHosts, o.expand(name))
+		}
+	} else {
+		o.knownHosts = []string{
+			filepath.Join(home(), ".ssh", "known_hosts"),
+			filepath.Join(home(), ".ssh", "known_hosts2"),
+		}
+	}
+	o.knownHosts = append(o.knownHosts, "/etc/ssh/ssh_known_hosts")
+	if v := get("ProxyJump"); v != "" && v != "none" {
+		o.jump = strings.Split(v, ",")
+	}
+	return o, nil
+}
+
+// HopOptions returns the options for reaching the jump host hop,
+// [user@]host[:port] or ssh://[user@]host[:port]. Jump hosts of the
+// jump host itself are ignored.
+func hopOptions(hop string) (*sshOptions, error) {
+	hop = strings.TrimPrefix(hop, "ssh://")
+	var params []string
+	dest := hop
+	if i := strings.LastIndex(hop, ":"); i > strings.LastIndex(hop, "@") && !strings.HasSuffix(hop, "]") {
+		dest = hop[:i]
+		params = append(params, "-p", hop[i+1:])
+	}
+	dest = strings.NewReplacer("[", "", "]", "").Replace(dest)
+	o, err := parseOptions(append(params, dest))
+	if err != nil {
+		return nil, err
+	}
+	o.jump = nil
+	return o, nil
+}
+
+// Expand expands the leading ~ and the % tokens of ssh_config(5) file
+// names that we know about.
+func (o *sshOptions) expand(name string) string {
+	if strings.HasPrefix(name, "~/") {
+		name = filepath.Join(home(), name[2:])
+	}
+	return strings.NewReplacer(
+		"%d", home(),
+		"%h", o.hostname,
+		"%r", o.user,
+		"%u", os.Getenv("USER"),
+		"%%", "%",
+	).Replace(name)
+}
+
+func home() string {
+	return os.Getenv("HOME")
+}
+
+// Dial connects to the remote end described by o, through its jump
+// hosts, if any, each reached through the previous one. Failures to
+// reach it are connErrors; failures to authenticate are not, retrying
+// won't help.
+func dial(o *sshOptions) (*gossh.Client, error) {
+	var hops []*gossh.Client
+	closeHops := func() {
+		for i := len(hops) - 1; i >= 0; i-- {
+			hops[i].Close()
+		}
+	}
+	var via *gossh.Client
+	for _, hop := range o.jump {
+		ho, err := hopOptions(hop)
+		if err != nil {
+			closeHops()
+			return nil, err
+		}
+		if via, err = dialVia(via, ho); err != nil {
+			closeHops()
+			return nil, fmt.Errorf("jump host %s: %w", hop, err)
+		}
+		hops = append(hops, via)
+	}
+	c, err := dialVia(via, o)
+	if err != nil {
+		closeHops()
+		return nil, err
+	}
+	if len(hops) > 0 {
+		go func() {
+			c.Wait()
+			closeHops()
+		}()
+	}
+	return c, nil
+}
+
+// DialVia connects to the host described by o, through the connection
+// via, if it's not nil.
+func dialVia(via *gossh.Client, o *sshOptions) (*gossh.Client, error) {
+	addr := net.JoinHostPort(o.hostname, o.port)
+	config, err := clientConfig(o, addr)
+	if err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	if via != nil {
+		conn, err = via.Dial("tcp", addr)
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, 30*time.Second)
+	}
+	if err != nil {
+		return nil, connError{err}
+	}
+	c, chans, reqs, err := gossh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		var kerr *knownhosts.KeyError
+		switch {
+		case errors.As(err, &kerr) && len(kerr.Want) == 0:
+			return nil, fmt.Errorf("host key for %s is not known; connect once with ssh(1) to add it", o.host)
+		case errors.As(err, &kerr):
+			return nil, fmt.Errorf("host key for %s has changed", o.host)
+		case strings.Contains(err.Error(), "unable to authenticate"):
+			return nil, err
+		}
+		return nil, connError{err}
+	}
+	return gossh.NewClient(c, chans, reqs), nil
+}
+
+// ClientConfig returns the configuration for connecting to addr: the
+// keys from the agent and the identity files, and the known hosts.
+func clientConfig(o *sshOptions, addr string) (*gossh.ClientConfig, error) {
+	var signers []gossh.Signer
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			if s, err := agent.NewClient(conn).Signers(); err == nil {
+				signers = append(signers, s...)
+			}
+		}
+	}
+	for _, name := range o.identities {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		s, err := gossh.ParsePrivateKey(b)
+		var perr *gossh.PassphraseMissingError
+		if errors.As(err, &perr) {
+			// Can't ask for passphrases; use an agent.
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		signers = append(signers, s)
+	}
+	if len(signers) == 0 {
+		return nil, errors.New("no keys available, is ssh-agent running?")
+	}
+
+	var files []string
+	for _, name := range o.knownHosts {
+		if _, err := os.Stat(name); err == nil {
+			files = append(files, name)
+		}
+	}
+	if len(files) == 0 {
+		return nil, errors.New("no known_hosts files")
+	}
+	hostKey, err := knownhosts.New(files...)
+	if err != nil {
+		return nil, err
+	}
+	return &gossh.ClientConfig{
+		User:              o.user,
+		Auth:              []gossh.AuthMethod{gossh.PublicKeys(signers...)},
+		HostKeyCallback:   hostKey,
+		HostKeyAlgorithms: hostKeyAlgorithms(hostKey, addr),
+		Timeout:           30 * time.Second,
+	}, nil
+}
+
+// HostKeyAlgorithms returns the algorithms of the keys known for addr,
+// so that the server offers a key we can check, or nil if there are
+// none, in which case the connection will fail anyway.
+func hostKeyAlgorithms(hostKey gossh.HostKeyCallback, addr string) []string {
+	// The callback tells what it wants when shown a key it doesn't.
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil
+	}
+	probe, err := gossh.NewPublicKey(pub)
+	if err != nil {
+		return nil
+	}
+	var kerr *knownhosts.KeyError
+	if !errors.As(hostKey(addr, &net.TCPAddr{}, probe), &kerr) {
+		return nil
+	}
+	var algos []string
+	for _, k := range kerr.Want {
+		switch t := k.Key.Type(); t {
+		case gossh.KeyAlgoRSA:
+			algos = append(algos, gossh.KeyAlgoRSASHA512, gossh.KeyAlgoRSASHA256, t)
+		default:
+			algos = append(algos, t)
+		}
+	}
+	return algos
+}
+
+// ErrNoTCP is returned by remoteListen for the services tcpAllowed
+// doesn't allow through TCP ports.
+var errNoTCP = errors.New("not allowed through a TCP port")
+
+// RemoteListen asks the remote end to listen on the unix domain
+// socket of f. If unix domain socket forwarding is disabled, and
+// tcpFallback allows it, it falls back to a TCP port on the remote
+// loopback interface, or returns errNoTCP for services that may not
+// go that way. It returns the listener and its address as a Plan 9
+// dial string.
+func remoteListen(client *gossh.Client, f forward) (net.Listener, string, error) {
+	l, err := client.ListenUnix(f.remote)
+	if err == nil {
+		return l, "unix!" + f.remote, nil
+	}
+	if !tcpFallback() {
+		return nil, "", err
+	}
+	if !tcpAllowed(f.svc) {
+		return nil, "", errNoTCP
+	}
+	l, err2 := client.Listen("tcp", "127.0.0.1:0")
+	if err2 != nil {
+		return nil, "", err
+	}
+	a := l.Addr().(*net.TCPAddr)
+	log.Printf("unix domain socket forwarding refused, using TCP port %d", a.Port)
+	return l, fmt.Sprintf("tcp!127.0.0.1!%d", a.Port), nil
+}
+
+// ForwardTo accepts connections from l and connects them to the local
+// unix domain socket path, until l is closed.
+func forwardTo(l net.Listener, path string) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			d, err := net.Dial("unix", path)
+			if err != nil {
+				log.Print(err)
+				return
+			}
+			defer d.Close()
+			done := make(chan bool, 1)
+			go func() {
+				io.Copy(d, c)
+				closeWrite(d)
+				done <- true
+			}()
+			io.Copy(c, d)
+			closeWrite(c)
+			<-done
+		}()
+	}
+}
+
+// CloseWrite shuts down the writing side of conn, if it can.
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+	}
+}
+
+// Builtin is like ssh, but uses the built-in client instead of ssh(1).
+func builtin(args []string, command string, shell []string, session string, fwds []forward, exps []export) error {
+	o, err := parseOptions(args)
+	if err != nil {
+		return err
+	}
+	client, err := dial(o)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	var used []forward
+	var addrs []string
+	for _, f := range fwds {
+		l, addr, err := remoteListen(client, f)
+		if err == errNoTCP {
+			log.Printf("not forwarding %s through a TCP port", f.svc.Name)
+			continue
+		}
+		if err != nil {
+			return forwardError{fmt.Errorf("%s: %v", f.svc.Name, err)}
+		}
+		defer l.Close()
+		go forwardTo(l, f.local)
+		used = append(used, f)
+		addrs = append(addrs, addr)
+	}
+	var live []export
+	for _, e := range exps {
+		l, err := client.ListenUnix(e.remote)
+		if err != nil {
+			log.Printf("can't forward name space entry %s: %v", e.name, err)
+			continue
+		}
+		defer l.Close()
+		go forwardTo(l, e.local)
+		live = append(live, e)
+	}
+
+	sess, err := client.NewSession()
+	if err != nil {
+		return connError{err}
+	}
+	defer sess.Close()
+	sess.Stdin = os.Stdin
+	if session != "" {
+		// See ssh.
+		r, w, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		defer w.Close()
+		sess.Stdin = r
+	}
+	sess.Stdout = os.Stdout
+	sess.Stderr = os.Stderr
+
+	fd := int(os.Stdin.Fd())
+	if (command == "" || o.tty) && !o.notty && session == "" && term.IsTerminal(fd) {
+		w, h, err := term.GetSize(fd)
+		if err != nil {
+			w, h = 80, 24
+		}
+		modes := gossh.TerminalModes{gossh.ECHO: 1}
+		if err := sess.RequestPty(os.Getenv("TERM"), h, w, modes); err != nil {
+			return connError{err}
+		}
+		old, err := term.MakeRaw(fd)
+		if err != nil {
+			return err
+		}
+		defer term.Restore(fd, old)
+		winch := make(chan os.Signal, 1)
+		notifyResize(winch)
+		defer signal.Stop(winch)
+		go func() {
+			for range winch {
+				if w, h, err := term.GetSize(fd); err == nil {
+					sess.WindowChange(h, w)
+				}
+			}
+		}()
+	}
+
+	cmdline := strings.Join(shellCommand(shell, command, session, used, addrs, live), " ")
+	if err := sess.Start(cmdline); err != nil {
+		return connError{err}
+	}
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigc)
+	done := make(chan error, 1)
+	go func() {
+		done <- sess.Wait()
+	}()
+	for {
+		select {
+		case sig := <-sigc:
+			switch sig {
+			case syscall.SIGHUP:
+				sess.Signal(gossh.SIGHUP)
+			case syscall.SIGINT:
+				sess.Signal(gossh.SIGINT)
+			case syscall.SIGTERM:
+				sess.Signal(gossh.SIGTERM)
+			}
+			// Like ssh(1), die of the signal after passing it on.
+			return fmt.Errorf("signal: %v", sig)
+		case err := <-done:
+			var exiterr *gossh.ExitError
+			switch {
+			case err == nil:
+				return nil
+			case errors.As(err, &exiterr) && exiterr.Signal() != "":
+				// Ssh(1) exits with 255 then.
+				return fmt.Errorf("remote command killed by signal %s", exiterr.Signal())
+			case errors.As(err, &exiterr):
+				return exitError(exiterr.ExitStatus())
+			default:
+				return connError{err}
+			}
+		}
+	}
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"mgk.ro/cmd/plan9/internal/service"
+)
+
+// A testServer is an in-process sshd, which runs commands by playing
+// a remote client of the first service forwarded with -addr.
+type testServer struct {
+	addr string
+	key  gossh.Signer
+	unix bool // accept streamlocal-forward requests
+
+	mu     sync.Mutex
+	direct []string // destinations of direct-tcpip channels
+	cmds   []string // commands run
+	errs   []error  // failures of the commands
+}
+
+func newSigner(t *testing.T) (gossh.Signer, ed25519.PrivateKey) {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := gossh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, priv
+}
+
+// NewTestServer starts a server accepting the user key, and forwarding
+// unix domain sockets if unix is true.
+func newTestServer(t *testing.T, user gossh.PublicKey, unix bool) *testServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	key, _ := newSigner(t)
+	s := &testServer{addr: ln.Addr().String(), key: key, unix: unix}
+	config := &gossh.ServerConfig{
+		PublicKeyCallback: func(_ gossh.ConnMetadata, k gossh.PublicKey) (*gossh.Permissions, error) {
+			if bytes.Equal(k.Marshal(), user.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unknown key")
+		},
+	}
+	config.AddHostKey(key)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c, config)
+		}
+	}()
+	return s
+}
+
+func (s *testServer) serve(c net.Conn, config *gossh.ServerConfig) {
+	conn, chans, reqs, err := gossh.NewServerConn(c, config)
+	if err != nil {
+		c.Close()
+		return
+	}
+	defer conn.Close()
+	go s.globalRequests(reqs)
+	for nc := range chans {
+		switch nc.ChannelType() {
+		case "session":
+			go s.session(conn, nc)
+		case "direct-tcpip":
+			go s.directTCPIP(nc)
+		default:
+			nc.Reject(gossh.UnknownChannelType, nc.ChannelType())
+		}
+	}
+}
+
+func (s *testServer) globalRequests(reqs <-chan *gossh.Request) {
+	port := uint32(40000)
+	for r := range reqs {
+		switch r.Type {
+		case "streamlocal-forward@openssh.com":
+			r.Reply(s.unix, nil)
+		case "tcpip-forward":
+			// Nothing listens; the commands open the channels.
+			port++
+			r.Reply(true, gossh.Marshal(struct{ Port uint32 }{port}))
+		case "cancel-streamlocal-forward@openssh.com", "cancel-tcpip-forward":
+			r.Reply(true, nil)
+		default:
+			if r.WantReply {
+				r.Reply(false, nil)
+			}
+		}
+	}
+}
+
+func (s *testServer) session(conn *gossh.ServerConn, nc gossh.NewChannel) {
+	ch, reqs, err := nc.Accept()
+	if err != nil {
+		return
+	}
+	defer ch.Close()
+	go io.Copy(io.Discard, ch)
+	for r := range reqs {
+		if r.Type != "exec" {
+			if r.WantReply {
+				r.Reply(false, nil)
+			}
+			continue
+		}
+		var exec struct{ Command string }
+		gossh.Unmarshal(r.Payload, &exec)
+		r.Reply(true, nil)
+		status := uint32(0)
+		if err := s.run(conn, exec.Command); err != nil {
+			s.mu.Lock()
+			s.errs = append(s.errs, err)
+			s.mu.Unlock()
+			status = 1
+		}
+		ch.SendRequest("exit-status", false, gossh.Marshal(struct{ Status uint32 }{status}))
+		return
+	}
+}
+
+// Run records cmd, and if it names a devdraw address with -addr, plays
+// a client of it: it sends ping, and expects PING back.
+func (s *testServer) run(conn *gossh.ServerConn, cmd string) error {
+	s.mu.Lock()
+	s.cmds = append(s.cmds, cmd)
+	s.mu.Unlock()
+	f := strings.Fields(cmd)
+	var addr string
+	for i := 0; i < len(f)-1; i++ {
+		if f[i] == "-addr" {
+			addr = f[i+1]
+		}
+	}
+	if addr == "" {
+		return nil
+	}
+	var ch gossh.Channel
+	var reqs <-chan *gossh.Request
+	var err error
+	switch a := strings.Split(addr, "!"); a[0] {
+	case "unix":
+		ch, reqs, err = conn.OpenChannel("forwarded-streamlocal@openssh.com",
+			gossh.Marshal(struct{ SocketPath, Reserved string }{a[1], ""}))
+	case "tcp":
+		port, _ := strconv.Atoi(a[2])
+		ch, reqs, err = conn.OpenChannel("forwarded-tcpip", gossh.Marshal(struct {
+			Addr       string
+			Port       uint32
+			OriginAddr string
+			OriginPort uint32
+		}{a[1], uint32(port), "127.0.0.1", 1234}))
+	default:
+		return fmt.Errorf("bad address %q", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", addr, err)
+	}
+	go gossh.DiscardRequests(reqs)
+	defer ch.Close()
+	io.WriteString(ch, "ping")
+	ch.CloseWrite()
+	b, err := io.ReadAll(ch)
+	if err != nil {
+		return err
+	}
+	if string(b) != "PING" {
+		return fmt.Errorf("%s: got %q, want PING", addr, b)
+	}
+	return nil
+}
+
+func (s *testServer) directTCPIP(nc gossh.NewChannel) {
+	var dest struct {
+		Host     string
+		Port     uint32
+		OrigHost string
+		OrigPort uint32
+	}
+	gossh.Unmarshal(nc.ExtraData(), &dest)
+	addr := net.JoinHostPort(dest.Host, strconv.Itoa(int(dest.Port)))
+	s.mu.Lock()
+	s.direct = append(s.direct, addr)
+	s.mu.Unlock()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		nc.Reject(gossh.ConnectionFailed, err.Error())
+		return
+	}
+	ch, reqs, err := nc.Accept()
+	if err != nil {
+		c.Close()
+		return
+	}
+	go gossh.DiscardRequests(reqs)
+	go func() {
+		io.Copy(ch, c)
+		ch.CloseWrite()
+	}()
+	io.Copy(c, ch)
+	c.Close()
+}
+
+// TestHome makes a home directory with the user key and the host keys
+// of the servers, and points HOME at it.
+func testHome(t *testing.T, priv ed25519.PrivateKey, servers ...*testServer) {
+	t.Helper()
+	home := t.TempDir()
+	dir := filepath.Join(home, ".ssh")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	block, err := gossh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "id_ed25519"), pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var known bytes.Buffer
+	for _, s := range servers {
+		fmt.Fprintln(&known, knownhosts.Line([]string{knownhosts.Normalize(s.addr)}, s.key.PublicKey()))
+	}
+	if err := os.WriteFile(filepath.Join(dir, "known_hosts"), known.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HOME", home)
+	t.Setenv("USER", "glenda")
+	t.Setenv("SSH_AUTH_SOCK", "")
+}
+
+// FakeDevdraw listens on a unix domain socket, and answers every
+// connection with its input in upper case.
+func fakeDevdraw(t *testing.T) string {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "p9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	name := filepath.Join(dir, "devdraw")
+	ln, err := net.Listen("unix", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			b, _ := io.ReadAll(c)
+			c.Write(bytes.ToUpper(b))
+			c.Close()
+		}
+	}()
+	return name
+}
+
+// HostArgs returns the ssh options and destination for reaching s.
+func hostArgs(s *testServer) []string {
+	host, port, _ := net.SplitHostPort(s.addr)
+	return []string{"-p", port, host}
+}
+
+func testForwards(t *testing.T) []forward {
+	devdraw, _ := service.Lookup("devdraw")
+	snarf, _ := service.Lookup("snarf")
+	dir := t.TempDir()
+	return []forward{
+		{devdraw, fakeDevdraw(t), remoteSocket(dir)},
+		{snarf, fakeDevdraw(t), remoteSocket(dir)},
+	}
+}
+
+func (s *testServer) check(t *testing.T) []string {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, err := range s.errs {
+		t.Error(err)
+	}
+	return s.cmds
+}
+
+func TestBuiltinStreamLocal(t *testing.T) {
+	user, priv := newSigner(t)
+	s := newTestServer(t, user.PublicKey(), true)
+	testHome(t, priv, s)
+	fwds := testForwards(t)
+	if err := builtin(hostArgs(s), "acme", []string{"plan9-shell"}, "", fwds, nil); err != nil {
+		t.Fatalf("builtin: %v", err)
+	}
+	cmds := s.check(t)
+	if len(cmds) != 1 {
+		t.Fatalf("ran %q, want one command", cmds)
+	}
+	for _, want := range []string{
+		"plan9-shell",
+		"-addr unix!" + fwds[0].remote,
+		"-s snarf=unix!" + fwds[1].remote,
+		"-c acme",
+	} {
+		if !strings.Contains(cmds[0], want) {
+			t.Errorf("command %q lacks %q", cmds[0], want)
+		}
+	}
+}
+
+func TestBuiltinTCPFallback(t *testing.T) {
+	user, priv := newSigner(t)
+	s := newTestServer(t, user.PublicKey(), false)
+	testHome(t, priv, s)
+
+	t.Setenv("PLAN9_SSH_TCP", "")
+	err := builtin(hostArgs(s), "acme", []string{"plan9-shell"}, "", testForwards(t), nil)
+	var ferr forwardError
+	if !errors.As(err, &ferr) {
+		t.Fatalf("without PLAN9_SSH_TCP: got %v, want a forwardError", err)
+	}
+	if cmds := s.check(t); len(cmds) != 0 {
+		t.Fatalf("without PLAN9_SSH_TCP: ran %q", cmds)
+	}
+
+	tests := []struct {
+		tcp     string
+		devdraw bool
+	}{
+		{"devdraw", true},
+		{"plumb", false},
+		// Private services are never forwarded through TCP.
+		{"devdraw snarf", true},
+		{"snarf", false},
+	}
+	for i, tt := range tests {
+		t.Setenv("PLAN9_SSH_TCP", tt.tcp)
+		if err := builtin(hostArgs(s), "acme", []string{"plan9-shell"}, "", testForwards(t), nil); err != nil {
+			t.Fatalf("PLAN9_SSH_TCP=%q: builtin: %v", tt.tcp, err)
+		}
+		cmds := s.check(t)
+		if len(cmds) != i+1 {
+			t.Fatalf("PLAN9_SSH_TCP=%q: ran %q, want one more command", tt.tcp, cmds)
+		}
+		cmd := cmds[i]
+		if got := strings.Contains(cmd, "-addr tcp!127.0.0.1!"); got != tt.devdraw {
+			t.Errorf("PLAN9_SSH_TCP=%q: command %q forwards devdraw through TCP: %v, want %v", tt.tcp, cmd, got, tt.devdraw)
+		}
+		if strings.Contains(cmd, "snarf") {
+			t.Errorf("PLAN9_SSH_TCP=%q: command %q forwards snarf through TCP", tt.tcp, cmd)
+		}
+	}
+}
+
+func TestBuiltinExitStatus(t *testing.T) {
+	user, priv := newSigner(t)
+	s := newTestServer(t, user.PublicKey(), true)
+	testHome(t, priv, s)
+	// The devdraw socket doesn't exist, so the command fails.
+	devdraw, _ := service.Lookup("devdraw")
+	fwds := []forward{{devdraw, filepath.Join(t.TempDir(), "none"), remoteSocket(t.TempDir())}}
+	err := builtin(hostArgs(s), "acme", []string{"plan9-shell"}, "", fwds, nil)
+	if status, _ := exitStatus(err); status != 1 {
+		t.Errorf("got %v, status %d, want exit status 1", err, status)
+	}
+}
+
+func TestDialJump(t *testing.T) {
+	user, priv := newSigner(t)
+	jump1 := newTestServer(t, user.PublicKey(), true)
+	jump2 := newTestServer(t, user.PublicKey(), true)
+	target := newTestServer(t, user.PublicKey(), true)
+	testHome(t, priv, jump1, jump2, target)
+
+	args := append([]string{"-J", "glenda@" + jump1.addr + "," + jump2.addr}, hostArgs(target)...)
+	o, err := parseOptions(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(o.jump) != 2 {
+		t.Fatalf("jump hosts %q, want two", o.jump)
+	}
+	c, err := dial(o)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	sess, err := c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Run("echo hello"); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	jump1.check(t)
+	jump2.check(t)
+	if cmds := target.check(t); len(cmds) != 1 || cmds[0] != "echo hello" {
+		t.Errorf("target ran %q, want echo hello", cmds)
+	}
+	if len(jump1.direct) != 1 || jump1.direct[0] != jump2.addr {
+		t.Errorf("first jump host connected to %q, want %s", jump1.direct, jump2.addr)
+	}
+	if len(jump2.direct) != 1 || jump2.direct[0] != target.addr {
+		t.Errorf("second jump host connected to %q, want %s", jump2.direct, target.addr)
+	}
+	if len(target.direct) != 0 {
+		t.Errorf("target connected to %q", target.direct)
+	}
+}
+
+func TestDialUnknownHost(t *testing.T) {
+	user, priv := newSigner(t)
+	s := newTestServer(t, user.PublicKey(), true)
+	testHome(t, priv) // no known hosts
+	o, err := parseOptions(hostArgs(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dial(o)
+	if err == nil || !strings.Contains(err.Error(), "is not known") {
+		t.Fatalf("dial: got %v, want an unknown host key", err)
+	}
+	if connectionLost(err) {
+		t.Error("an unknown host key is taken for a lost connection")
+	}
+}
+
+// TestParseOptionsConfig checks the settings read from ssh_config(5)
+// files, and that options override them.
+func TestParseOptionsConfig(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("HOME", dir)
+	t.Setenv("USER", "glenda")
+	cfg := filepath.Join(dir, "config")
+	files := map[string]string{
+		cfg: `Include hosts/*
+Host *
+	ProxyJump none
+`,
+		filepath.Join(dir, "hosts", "devbox"): `Host devbox
+	HostName %h.example.org
+	User rob
+	Port 2222
+	ProxyJump gw1.example.org,ken@gw2.example.org:2200
+`,
+	}
+	for name, s := range files {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		args                 []string
+		hostname, user, port string
+		jump                 []string
+	}{
+		{[]string{"devbox"}, "devbox.example.org", "rob", "2222", []string{"gw1.example.org", "ken@gw2.example.org:2200"}},
+		{[]string{"-p", "22", "-J", "gw3", "ken@devbox"}, "devbox.example.org", "ken", "22", []string{"gw3"}},
+		{[]string{"-o", "ProxyJump=none", "devbox"}, "devbox.example.org", "rob", "2222", nil},
+		{[]string{"other"}, "other", "glenda", "22", nil},
+	}
+	for _, tt := range tests {
+		o, err := parseOptions(append([]string{"-F", cfg}, tt.args...))
+		if err != nil {
+			t.Errorf("%q: %v", tt.args, err)
+			continue
+		}
+		if o.hostname != tt.hostname || o.user != tt.user || o.port != tt.port || !reflect.DeepEqual(o.jump, tt.jump) {
+			t.Errorf("%q: got %s@%s:%s via %q, want %s@%s:%s via %q", tt.args,
+				o.user, o.hostname, o.port, o.jump, tt.user, tt.hostname, tt.port, tt.jump)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"mgk.ro/cmd/plan9/internal/sshconfig"
+)
+
+// A config holds the settings of the configuration file that apply to
+// a host. Empty settings are not set.
+type config struct {
+	devdraw    []string // local devdraw command line
+	services   []string // services forwarded besides devdraw
+	namespace  []string // name space entries to forward
+	shell      string   // shell run by plan9-shell
+	plan9shell string   // remote plan9-shell
+	command    string   // command to run if none is given
+}
+
+// ConfigKeys lists the keywords of the configuration file.
+var configKeys = []string{"devdraw", "services", "namespace", "shell", "plan9shell", "command"}
+
+// DefaultConfig returns the name of the configuration file,
+// $PLAN9_SSH_CONFIG, or else $XDG_CONFIG_HOME/plan9-ssh, or
+// $HOME/.config/plan9-ssh.
+func defaultConfig() string {
+	if name := os.Getenv("PLAN9_SSH_CONFIG"); name != "" {
+		return name
+	}
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		dir = filepath.Join(os.Getenv("HOME"), ".config")
+	}
+	return filepath.Join(dir, "plan9-ssh")
+}
+
+// ReadConfig reads the settings for host from the configuration file
+// name. A missing file sets nothing.
+func readConfig(name, host string) (*config, error) {
+	cfg, err := sshconfig.ParseFile(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range cfg.Keys() {
+		known := false
+		for _, k := range configKeys {
+			known = known || k == key
+		}
+		if !known {
+			return nil, fmt.Errorf("%s: unknown keyword %q", name, key)
+		}
+	}
+	one := func(key string) (string, error) {
+		v := cfg.Get(host, key)
+		if len(v) > 1 {
+			return "", fmt.Errorf("%s: %s takes one argument", name, key)
+		}
+		return strings.Join(v, ""), nil
+	}
+	// List is for lists where none means an empty one.
+	list := func(key string) []string {
+		v := cfg.Get(host, key)
+		if len(v) == 1 && v[0] == "none" {
+			return []string{}
+		}
+		return v
+	}
+	c := &config{
+		devdraw:   cfg.Get(host, "Devdraw"),
+		services:  list("Services"),
+		namespace: list("Namespace"),
+	}
+	// The command is a string for the shell run by plan9-shell,
+	// like one given on the command line, so keep the words as they
+	// were split. That shell isn't known, POSIX quoting will do.
+	for _, w := range cfg.Get(host, "Command") {
+		if c.command != "" {
+			c.command += " "
+		}
+		c.command += shellQuote("sh", w)
+	}
+	if c.shell, err = one("Shell"); err != nil {
+		return nil, err
+	}
+	if c.plan9shell, err = one("Plan9Shell"); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
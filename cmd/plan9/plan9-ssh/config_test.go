@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadConfig(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "plan9-ssh")
+	err := os.WriteFile(name, []byte(`Host devbox
+	Command acme -l "$HOME/acme dump" it's
+	Services none
+	Shell rc
+
+Host *
+	Command 9term
+	Devdraw devdraw -D
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := readConfig(name, "devbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `acme -l '$HOME/acme dump' 'it'\''s'`; cfg.command != want {
+		t.Errorf("command %s, want %s", cfg.command, want)
+	}
+	if cfg.services == nil || len(cfg.services) != 0 {
+		t.Errorf("services %q, want an empty list", cfg.services)
+	}
+	if cfg.shell != "rc" {
+		t.Errorf("shell %q, want rc", cfg.shell)
+	}
+	if len(cfg.devdraw) != 2 || cfg.devdraw[1] != "-D" {
+		t.Errorf("devdraw %q, want devdraw -D", cfg.devdraw)
+	}
+
+	cfg, err = readConfig(name, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.command != "9term" || cfg.services != nil || cfg.shell != "" {
+		t.Errorf("other host: %+v", cfg)
+	}
+
+	if cfg, err = readConfig(filepath.Join(t.TempDir(), "none"), "devbox"); err != nil || cfg.command != "" {
+		t.Errorf("missing file: %+v, %v", cfg, err)
+	}
+}
@@ -0,0 +1,318 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// The end-to-end tests run plan9-ssh with the real plan9-shell and
+// devdraw-proxy, built for the occasion, and with fakes of ssh(1),
+// devdraw and a plan9port program, all played by the test binary
+// itself under their names.
+func TestMain(m *testing.M) {
+	switch filepath.Base(os.Args[0]) {
+	case "plan9-ssh":
+		main()
+	case "ssh":
+		e2eSSH(os.Args[1:])
+	case "devdraw":
+		e2eDevdraw()
+	case "e2eclient":
+		e2eClient(os.Args[1:])
+	}
+	status := m.Run()
+	if e2eBuild.dir != "" {
+		os.RemoveAll(e2eBuild.dir)
+	}
+	os.Exit(status)
+}
+
+// E2eBuild holds plan9-shell and devdraw-proxy, once built.
+var e2eBuild struct {
+	once sync.Once
+	dir  string
+	err  error
+}
+
+// E2eBinaries builds plan9-shell and devdraw-proxy, on first use, and
+// returns the directory holding them.
+func e2eBinaries(t *testing.T) string {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("builds plan9-shell and devdraw-proxy")
+	}
+	b := &e2eBuild
+	b.once.Do(func() {
+		if b.dir, b.err = os.MkdirTemp("", "plan9-ssh-e2e."); b.err != nil {
+			return
+		}
+		cmd := exec.Command("go", "build", "-o", b.dir, "mgk.ro/cmd/plan9/plan9-shell", "mgk.ro/cmd/plan9/devdraw-proxy")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			b.err = fmt.Errorf("go build: %v\n%s", err, out)
+		}
+	})
+	if b.err != nil {
+		t.Fatal(b.err)
+	}
+	return b.dir
+}
+
+// E2eSSH plays ssh(1) with the remote end on the local machine: it
+// listens on the remote sockets of the -R options, forwards their
+// connections to the local sockets, and runs the command with sh(1).
+// Like sshd(8), it leaves the remote sockets for plan9-shell to
+// remove.
+// If $E2E_SSH_EXIT is set, it exits with that status straight away,
+// as if the connection failed. See e2eRemote for the failing
+// forwards.
+func e2eSSH(args []string) {
+	if s := os.Getenv("E2E_SSH_EXIT"); s != "" {
+		n, _ := strconv.Atoi(s)
+		os.Exit(n)
+	}
+	// Like ssh(1), take options after the destination too.
+	dest := ""
+	i := 0
+	for ; i < len(args); i++ {
+		if !strings.HasPrefix(args[i], "-") {
+			if dest != "" {
+				break
+			}
+			dest = args[i]
+			continue
+		}
+		switch args[i] {
+		case "-R":
+			i++
+			network, remote, local := e2eRemote(args[i])
+			l, err := net.Listen(network, remote)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "ssh:", err)
+				os.Exit(255)
+			}
+			go e2eForward(l, local)
+		case "-o", "-p", "-l":
+			i++
+		}
+	}
+	if dest == "" {
+		fmt.Fprintln(os.Stderr, "ssh: no destination")
+		os.Exit(255)
+	}
+	cmd := exec.Command("/bin/sh", "-c", strings.Join(args[i:], " "))
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	var exiterr *exec.ExitError
+	switch {
+	case errors.As(err, &exiterr):
+		os.Exit(exiterr.ExitCode())
+	case err != nil:
+		fmt.Fprintln(os.Stderr, "ssh:", err)
+		os.Exit(255)
+	}
+	os.Exit(0)
+}
+
+// E2eRemote returns the remote and local ends of the -R option spec.
+// If $E2E_SSH_NOUNIX is set, it refuses to forward unix domain
+// sockets, and if $E2E_SSH_BUSY is set, it takes the first TCP port
+// asked for to be in use, failing the forward as ssh(1) does.
+func e2eRemote(spec string) (network, remote, local string) {
+	network = "unix"
+	remote, local, _ = strings.Cut(spec, ":")
+	if remote == "127.0.0.1" {
+		port, rest, _ := strings.Cut(local, ":")
+		network, remote, local = "tcp", "127.0.0.1:"+port, rest
+	}
+	busy := filepath.Join(os.Getenv("HOME"), "busy")
+	refuse := network == "unix" && os.Getenv("E2E_SSH_NOUNIX") != ""
+	if network == "tcp" && os.Getenv("E2E_SSH_BUSY") != "" {
+		if _, err := os.Stat(busy); err != nil {
+			os.WriteFile(busy, nil, 0600)
+			refuse = true
+		}
+	}
+	if refuse {
+		fmt.Fprintf(os.Stderr, "Error: remote port forwarding failed for listen path %s\n", remote)
+		os.Exit(255)
+	}
+	return network, remote, local
+}
+
+// E2eForward relays the connections accepted by l to the unix domain
+// socket local, passing half-closes on.
+func e2eForward(l net.Listener, local string) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			d, err := net.Dial("unix", local)
+			if err != nil {
+				return
+			}
+			defer d.Close()
+			go func() {
+				io.Copy(d, c)
+				d.(*net.UnixConn).CloseWrite()
+			}()
+			io.Copy(c, d)
+		}()
+	}
+}
+
+// E2eDevdraw plays devdraw: it answers its input in upper case.
+func e2eDevdraw() {
+	b, _ := io.ReadAll(os.Stdin)
+	os.Stdout.Write(bytes.ToUpper(b))
+	os.Exit(0)
+}
+
+// E2eClient plays a plan9port program: it runs $DEVDRAW, as libdraw
+// does, sends it its arguments, and prints the reply. It exits with
+// $E2E_CLIENT_EXIT, if set.
+func e2eClient(args []string) {
+	cmd := exec.Command(os.Getenv("DEVDRAW"))
+	cmd.Stdin = strings.NewReader(strings.Join(args, " "))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		fmt.Fprintln(os.Stderr, "client:", err)
+		os.Exit(1)
+	}
+	n, _ := strconv.Atoi(os.Getenv("E2E_CLIENT_EXIT"))
+	os.Exit(n)
+}
+
+// E2eEnv sets up the programs in a bin directory on PATH, and a local
+// name space with a plumber socket, and returns the plan9-ssh to run,
+// and the directory holding the local and remote runtime directories.
+func e2eEnv(t *testing.T) (prog, dir string) {
+	t.Helper()
+	built := e2eBinaries(t)
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir = t.TempDir()
+	bin := filepath.Join(dir, "bin")
+	if err := os.Mkdir(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"plan9-ssh", "ssh", "devdraw", "e2eclient"} {
+		if err := os.Symlink(exe, filepath.Join(bin, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"plan9-shell", "devdraw-proxy"} {
+		if err := os.Symlink(filepath.Join(built, name), filepath.Join(bin, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rundir := filepath.Join(dir, "run")
+	if err := os.Mkdir(rundir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	ns := t.TempDir()
+	l, err := net.Listen("unix", filepath.Join(ns, "plumb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("HOME", dir)
+	t.Setenv("SHELL", "/bin/sh")
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	t.Setenv("XDG_RUNTIME_DIR", rundir)
+	t.Setenv("NAMESPACE", ns)
+	t.Setenv("PLAN9_SSH_CONFIG", "")
+	t.Setenv("PLAN9_SSH_SSH", "")
+	t.Setenv("PLAN9_SSH_CLIENT", "")
+	t.Setenv("PLAN9_SSH_SESSION", "")
+	t.Setenv("PLAN9_SSH_SERVICES", "")
+	t.Setenv("PLAN9_SSH_NAMESPACE", "plumb")
+	t.Setenv("PLAN9_SSH_INSTALL", "no")
+	t.Setenv("DEVDRAW", "")
+	t.Setenv("E2E_SSH_EXIT", "")
+	t.Setenv("E2E_CLIENT_EXIT", "")
+	return filepath.Join(bin, "plan9-ssh"), dir
+}
+
+// Leftovers returns the sockets and state files left in dir by
+// plan9-ssh and, on the remote end, plan9-shell. The records of the
+// remote ends are meant to stay.
+func leftovers(t *testing.T, dir string) []string {
+	t.Helper()
+	var left []string
+	filepath.Walk(dir, func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() && fi.Name() == "installed" {
+			return filepath.SkipDir
+		}
+		if fi.Mode()&os.ModeSocket != 0 || strings.HasSuffix(name, ".json") {
+			left = append(left, name)
+		}
+		return nil
+	})
+	return left
+}
+
+func TestEndToEnd(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    []string
+		status int
+		out    string
+	}{
+		{"ok", nil, 0, "PING"},
+		{"command fails", []string{"E2E_CLIENT_EXIT=3"}, 3, "PING"},
+		{"connection fails", []string{"E2E_SSH_EXIT=255"}, 255, ""},
+		{"tcp", []string{"E2E_SSH_NOUNIX=1", "PLAN9_SSH_TCP=devdraw"}, 0, "PING"},
+		{"tcp port busy", []string{"E2E_SSH_NOUNIX=1", "E2E_SSH_BUSY=1", "PLAN9_SSH_TCP=devdraw"}, 0, "PING"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prog, dir := e2eEnv(t)
+			cmd := exec.Command(prog, "glenda@example.org", "e2eclient ping")
+			cmd.Env = append(os.Environ(), tt.env...)
+			var stdout, stderr bytes.Buffer
+			cmd.Stdout = &stdout
+			cmd.Stderr = &stderr
+			err := cmd.Run()
+			status := 0
+			var exiterr *exec.ExitError
+			if errors.As(err, &exiterr) {
+				status = exiterr.ExitCode()
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if status != tt.status {
+				t.Errorf("exit status %d, want %d; stderr:\n%s", status, tt.status, stderr.Bytes())
+			}
+			if stdout.String() != tt.out {
+				t.Errorf("output %q, want %q; stderr:\n%s", stdout.String(), tt.out, stderr.Bytes())
+			}
+			if left := leftovers(t, dir); len(left) > 0 {
+				t.Errorf("left behind %q", left)
+			}
+		})
+	}
+}
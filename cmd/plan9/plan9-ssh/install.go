@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// A runner runs the shell command cmd on the remote end described
+// by args, with stdin as its input, and returns its output.
+type runner func(args []string, cmd string, stdin io.Reader) ([]byte, error)
+
+// SshRun is the runner that uses ssh(1).
+func sshRun(args []string, cmd string, stdin io.Reader) ([]byte, error) {
+	c := exec.Command(sshProg(), append(append([]string{"-T"}, args...), cmd)...)
+	c.Stdin = stdin
+	c.Stderr = os.Stderr
+	return c.Output()
+}
+
+// BuiltinRun is the runner that uses the built-in client.
+func builtinRun(args []string, cmd string, stdin io.Reader) ([]byte, error) {
+	o, err := parseOptions(args)
+	if err != nil {
+		return nil, err
+	}
+	client, err := dial(o)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	sess, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer sess.Close()
+	sess.Stdin = stdin
+	sess.Stderr = os.Stderr
+	return sess.Output(cmd)
+}
+
+// The probe creates the remote runtime directory, and prints a marker,
+// so that noise from the remote login scripts can be skipped, the
+// plan9-shell in the remote PATH, if any, the system and machine names,
+// the home directory, the name of the login shell, and the installed
+// plan9-shells. It has no single quotes, so that quote quotes it the
+// same for every shell.
+const probe = `umask 077 && mkdir -p "$HOME/.cache/plan9-ssh/run" && chmod 700 "$HOME/.cache/plan9-ssh/run" || exit 1; echo plan9-ssh-probe; command -v plan9-shell || echo; uname -s; uname -m; echo "$HOME"; echo "${SHELL##*/}"; ls "$HOME/.cache/plan9-ssh" 2>/dev/null || true`
+
+// RemoteDir is where plan9-shell is installed, relative to the
+// remote home directory.
+const remoteDir = ".cache/plan9-ssh"
+
+// RemoteRundir is the remote runtime directory, relative to the remote
+// home directory. It's accessible only by the user, so the remote
+// sockets are forwarded straight into it.
+const remoteRundir = remoteDir + "/run"
+
+// Setup probes the remote end described by args, creating its runtime
+// directory, and returns a record of it, and whether plan9-shell was
+// uploaded. A plan9-shell in the remote PATH is used as is. Otherwise,
+// if upload is true, one built for the remote system is uploaded to
+// $HOME/.cache/plan9-ssh, named after its hash so that different
+// versions don't clash. The record is remembered for lookupRemote.
+func setup(args []string, run runner, upload bool) (installRecord, bool, error) {
+	out, err := run(args, "sh -c "+quote(probe), nil)
+	if err != nil {
+		return installRecord{}, false, fmt.Errorf("probing remote host: %v", err)
+	}
+	lines := strings.Split(string(out), "\n")
+	for len(lines) > 0 && lines[0] != "plan9-ssh-probe" {
+		lines = lines[1:]
+	}
+	if len(lines) < 6 {
+		return installRecord{}, false, errors.New("probing remote host: unexpected output")
+	}
+	path, sys, machine, home, login, installed := lines[1], lines[2], lines[3], lines[4], lines[5], lines[6:]
+	rec := installRecord{Shell: "plan9-shell", Rundir: home + "/" + remoteRundir, Login: login}
+	if path != "" || !upload {
+		rememberRemote(args, rec)
+		return rec, false, nil
+	}
+	goos, goarch, err := goSystem(sys, machine)
+	if err != nil {
+		return installRecord{}, false, err
+	}
+	bin, name, err := shellBinary(goos, goarch)
+	if err != nil {
+		return installRecord{}, false, fmt.Errorf("plan9-shell is not installed on the remote host, and can't be built for %s/%s: %v", goos, goarch, err)
+	}
+	rec.Shell = home + "/" + remoteDir + "/" + name
+	rec.GOOS, rec.GOARCH = goos, goarch
+	for _, s := range installed {
+		if s == name {
+			rememberRemote(args, rec)
+			return rec, false, nil
+		}
+	}
+	log.Printf("installing %s on the remote host", rec.Shell)
+	cmd := fmt.Sprintf(`mkdir -p "$HOME/%s" && cat >"$HOME/%s/%s.$$" && chmod 755 "$HOME/%[2]s/%[3]s.$$" && mv "$HOME/%[2]s/%[3]s.$$" "$HOME/%[2]s/%[3]s"`, remoteDir, remoteDir, name)
+	if _, err := run(args, "sh -c "+quote(cmd), bytes.NewReader(bin)); err != nil {
+		return installRecord{}, false, fmt.Errorf("installing plan9-shell: %v", err)
+	}
+	rememberRemote(args, rec)
+	return rec, true, nil
+}
+
+// An installRecord remembers the plan9-shell found on, or uploaded
+// to, a remote end, its runtime directory, and its login shell, so
+// that later runs needn't probe it.
+type installRecord struct {
+	Shell  string
+	GOOS   string // remote system, if Shell was uploaded
+	GOARCH string
+	Rundir string
+	Login  string // name of the login shell, for quote
+}
+
+// InstallFile returns the name of the file recording the remote end described by args. The records are kept in the
+// installed directory under the state directory, named after the hash
+// of args, since the same host name may lead to different places with
+// different options.
+func installFile(args []string) (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	dir = filepath.Join(dir, "installed")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(strings.Join(args, "\x00")))
+	return filepath.Join(dir, hex.EncodeToString(sum[:8])+".json"), nil
+}
+
+// LookupRemote returns the record remembered for the remote end
+// described by args. It reports false if there's none, or if its
+// plan9-shell is not the version that would be uploaded now.
+func lookupRemote(args []string) (installRecord, bool) {
+	var rec installRecord
+	name, err := installFile(args)
+	if err != nil {
+		return rec, false
+	}
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return rec, false
+	}
+	if err := json.Unmarshal(b, &rec); err != nil || rec.Shell == "" || rec.Rundir == "" {
+		return rec, false
+	}
+	if rec.GOOS != "" {
+		_, bin, err := shellBinary(rec.GOOS, rec.GOARCH)
+		if err != nil || path.Base(rec.Shell) != bin {
+			return rec, false
+		}
+	}
+	return rec, true
+}
+
+// RememberRemote records rec for the remote end described by args.
+// It's a best effort function; without the record, the next run probes
+// the remote end again.
+func rememberRemote(args []string, rec installRecord) {
+	name, err := installFile(args)
+	if err != nil {
+		return
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	os.WriteFile(name, b, 0600)
+}
+
+// ForgetRemote removes the record of the remote end described by args.
+func forgetRemote(args []string) {
+	if name, err := installFile(args); err == nil {
+		os.Remove(name)
+	}
+}
+
+// ShellBinary returns the plan9-shell binary for goos/goarch, and the
+// name it's installed under on the remote end.
+func shellBinary(goos, goarch string) ([]byte, string, error) {
+	bin, err := localShell(goos, goarch)
+	if err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256(bin)
+	return bin, "plan9-shell-" + hex.EncodeToString(sum[:6]), nil
+}
+
+// GoSystem maps the output of uname -s and uname -m to GOOS and
+// GOARCH.
+func goSystem(sys, machine string) (goos, goarch string, err error) {
+	goos = strings.ToLower(sys)
+	switch goos {
+	case "linux", "darwin", "freebsd", "openbsd", "netbsd", "dragonfly", "solaris", "illumos":
+	default:
+		return "", "", fmt.Errorf("unsupported remote system %q", sys)
+	}
+	switch machine {
+	case "x86_64", "amd64":
+		goarch = "amd64"
+	case "aarch64", "arm64":
+		goarch = "arm64"
+	case "i386", "i486", "i586", "i686", "i86pc":
+		goarch = "386"
+	case "armv6l", "armv7l", "armv7", "arm":
+		goarch = "arm"
+	case "riscv64", "ppc64le", "ppc64", "s390x", "mips64", "mips64le":
+		goarch = machine
+	default:
+		return "", "", fmt.Errorf("unsupported remote machine %q", machine)
+	}
+	return goos, goarch, nil
+}
+
+// LocalShell returns a plan9-shell binary for goos/goarch. For the
+// local system, that's the plan9-shell next to plan9-ssh, or in PATH.
+// Otherwise it's built by build into the cache directory,
+// $XDG_CACHE_HOME/plan9-ssh, and kept there for the next time, unless
+// plan9-ssh is a development build.
+func localShell(goos, goarch string) ([]byte, error) {
+	if goos == runtime.GOOS && goarch == runtime.GOARCH {
+		if exe, err := os.Executable(); err == nil {
+			if b, err := os.ReadFile(filepath.Join(filepath.Dir(exe), "plan9-shell")); err == nil {
+				return b, nil
+			}
+		}
+		if name, err := exec.LookPath("plan9-shell"); err == nil {
+			return os.ReadFile(name)
+		}
+	}
+	version, src, err := shellSource()
+	if err != nil {
+		return nil, err
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	dir = filepath.Join(dir, "plan9-ssh")
+	cached := filepath.Join(dir, fmt.Sprintf("plan9-shell-%s-%s-%s", version, goos, goarch))
+	if src != "" {
+		cached = filepath.Join(dir, fmt.Sprintf("plan9-shell-devel-%s-%s", goos, goarch))
+	} else if b, err := os.ReadFile(cached); err == nil {
+		return b, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := build(cached, version, src, goos, goarch); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(cached)
+}
+
+// ShellSource returns where the plan9-shell matching plan9-ssh comes
+// from: the module version of plan9-ssh, if it's a release, or else
+// the source tree of a development build. A development build is one
+// with no version, or one built from a modified checkout.
+func shellSource() (version, src string, err error) {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok || bi.Main.Path != "mgk.ro" {
+		return "", "", errors.New("plan9-ssh wasn't built from module mgk.ro; can't build a matching plan9-shell")
+	}
+	if v := bi.Main.Version; v != "" && v != "(devel)" && !strings.Contains(v, "+") {
+		return v, "", nil
+	}
+	// The source file names recorded in the binary point into the
+	// tree it was built from, unless it was built with -trimpath.
+	_, file, _, ok := runtime.Caller(0)
+	src = filepath.Join(filepath.Dir(file), "..", "..", "..")
+	if fi, err := os.Stat(filepath.Join(src, "cmd", "plan9", "plan9-shell")); ok && err == nil && fi.IsDir() {
+		return "", src, nil
+	}
+	return "", "", errors.New("plan9-ssh is a development build, and its source tree is gone; can't build a matching plan9-shell")
+}
+
+// Build cross-compiles plan9-shell into the file name: with go build
+// in the source tree src, if it isn't empty, or else with go install
+// of the given version. Any other version of plan9-shell might not
+// speak the same protocol as plan9-ssh, so there's no falling back to
+// the latest one.
+func build(name, version, src, goos, goarch string) error {
+	env := append(os.Environ(),
+		"GOOS="+goos,
+		"GOARCH="+goarch,
+		"CGO_ENABLED=0",
+	)
+	if src != "" {
+		log.Printf("building plan9-shell for %s/%s in %s", goos, goarch, src)
+		cmd := exec.Command("go", "build", "-o", name, "./cmd/plan9/plan9-shell")
+		cmd.Dir = src
+		cmd.Env = env
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("go build: %v", err)
+		}
+		return nil
+	}
+	modcache, err := exec.Command("go", "env", "GOMODCACHE").Output()
+	if err != nil {
+		return fmt.Errorf("go env: %v", err)
+	}
+	gopath, err := os.MkdirTemp(filepath.Dir(name), "gopath.")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(gopath)
+	log.Printf("building plan9-shell %s for %s/%s", version, goos, goarch)
+	cmd := exec.Command("go", "install", "mgk.ro/cmd/plan9/plan9-shell@"+version)
+	cmd.Env = append(env,
+		"GOPATH="+gopath,
+		"GOMODCACHE="+strings.TrimSpace(string(modcache)),
+		"GOBIN=",
+	)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("can't build plan9-shell %s to match plan9-ssh: go install: %v", version, err)
+	}
+	bin := filepath.Join(gopath, "bin", goos+"_"+goarch, "plan9-shell")
+	if goos == runtime.GOOS && goarch == runtime.GOARCH {
+		bin = filepath.Join(gopath, "bin", "plan9-shell")
+	}
+	return os.Rename(bin, name)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// A fakeRemote is a runner that plays a remote end, with plan9-shell
+// in PATH if inPath is true, and the plan9-shells in installed.
+type fakeRemote struct {
+	inPath    bool
+	installed []string
+	cmds      []string
+}
+
+func (r *fakeRemote) run(args []string, cmd string, stdin io.Reader) ([]byte, error) {
+	r.cmds = append(r.cmds, cmd)
+	if stdin != nil {
+		io.Copy(io.Discard, stdin)
+		i := strings.Index(cmd, "plan9-shell-")
+		name := cmd[i : i+len("plan9-shell-")+12]
+		r.installed = append(r.installed, name)
+		return nil, nil
+	}
+	path := ""
+	if r.inPath {
+		path = "/usr/local/bin/plan9-shell"
+	}
+	out := []string{"motd", "plan9-ssh-probe", path, runtime.GOOS, runtime.GOARCH, "/home/glenda", "rc"}
+	out = append(out, r.installed...)
+	return []byte(strings.Join(out, "\n") + "\n"), nil
+}
+
+// TestSetupRemembered checks that the outcome of setup is remembered
+// per remote end, and forgotten when the local plan9-shell changes.
+func TestSetupRemembered(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	bin := t.TempDir()
+	t.Setenv("PATH", bin)
+	local := filepath.Join(bin, "plan9-shell")
+	if err := os.WriteFile(local, []byte("version 1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	host := []string{"-p", "2222", "glenda@example.org"}
+	other := []string{"glenda@example.org"}
+	if rec, ok := lookupRemote(host); ok {
+		t.Fatalf("lookupRemote before setup = %+v", rec)
+	}
+	r := &fakeRemote{}
+	rec, uploaded, err := setup(host, r.run, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !uploaded || !strings.HasPrefix(rec.Shell, "/home/glenda/.cache/plan9-ssh/plan9-shell-") {
+		t.Fatalf("setup = %+v, %v; want an upload to the cache", rec, uploaded)
+	}
+	if rec.Rundir != "/home/glenda/.cache/plan9-ssh/run" {
+		t.Errorf("remote runtime directory %q", rec.Rundir)
+	}
+	if rec.Login != "rc" {
+		t.Errorf("remote login shell %q, want rc", rec.Login)
+	}
+	if len(r.cmds) != 2 {
+		t.Errorf("setup ran %q, want a probe and an upload", r.cmds)
+	}
+	if got, ok := lookupRemote(host); !ok || got != rec {
+		t.Errorf("lookupRemote = %+v, %v; want %+v", got, ok, rec)
+	}
+	if got, ok := lookupRemote(other); ok {
+		t.Errorf("lookupRemote with other options = %+v", got)
+	}
+
+	// Setting up again finds the uploaded one.
+	rec2, uploaded, err := setup(host, r.run, true)
+	if err != nil || uploaded || rec2 != rec {
+		t.Errorf("second setup = %+v, %v, %v; want %+v, no upload", rec2, uploaded, err, rec)
+	}
+
+	if err := os.WriteFile(local, []byte("version 2"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := lookupRemote(host); ok {
+		t.Errorf("lookupRemote after an update = %+v", got)
+	}
+
+	for _, upload := range []bool{true, false} {
+		forgetRemote(host)
+		r = &fakeRemote{inPath: upload}
+		rec, uploaded, err := setup(host, r.run, upload)
+		if err != nil || uploaded || rec.Shell != "plan9-shell" {
+			t.Fatalf("setup with upload %v = %+v, %v, %v; want plan9-shell", upload, rec, uploaded, err)
+		}
+		if len(r.cmds) != 1 {
+			t.Errorf("setup with upload %v ran %q, want a probe", upload, r.cmds)
+		}
+		if got, ok := lookupRemote(host); !ok || got.Shell != "plan9-shell" {
+			t.Errorf("lookupRemote = %+v, %v; want plan9-shell", got, ok)
+		}
+	}
+	forgetRemote(host)
+	if got, ok := lookupRemote(host); ok {
+		t.Errorf("lookupRemote after forgetRemote = %+v", got)
+	}
+}
+
+// TestBuildDevel checks that a development build of plan9-ssh, such
+// as the test binary, builds plan9-shell from its own source tree.
+func TestBuildDevel(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds plan9-shell")
+	}
+	version, src, err := shellSource()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "" {
+		t.Fatalf("shellSource returned version %q for a development build", version)
+	}
+	if _, err := os.Stat(filepath.Join(src, "go.mod")); err != nil {
+		t.Fatalf("source tree %s: %v", src, err)
+	}
+	name := filepath.Join(t.TempDir(), "plan9-shell")
+	if err := build(name, version, src, "linux", "arm64"); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(name); err != nil || fi.Size() == 0 {
+		t.Fatalf("no plan9-shell built: %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"mgk.ro/cmd/plan9/internal/resume"
+	"mgk.ro/cmd/plan9/internal/service"
+)
+
+// MaxCommands bounds the number of local commands a server runs at
+// the same time.
+const maxCommands = 32
+
+// A server runs the local command of a service for every connection
+// forwarded from the remote end.
+type server struct {
+	svc  service.Service
+	name string // socket file
+	l    net.Listener
+	sem  chan bool // a token for each running command
+}
+
+// Listen returns a server for svc listening on the unix domain socket
+// name.
+func listen(name string, svc service.Service) (*server, error) {
+	l, err := net.Listen("unix", name)
+	if err != nil {
+		return nil, err
+	}
+	return &server{
+		svc:  svc,
+		name: name,
+		l:    l,
+		sem:  make(chan bool, maxCommands),
+	}, nil
+}
+
+// Serve accepts connections until the server is closed. Failures of
+// individual connections are logged, but don't stop the server.
+func (s *server) serve() {
+	var delay time.Duration
+	for {
+		conn, err := s.l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			// Probably out of file descriptors; back off,
+			// like net/http does.
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay < time.Second {
+				delay *= 2
+			}
+			log.Printf("%s: %v; retrying in %v", s.svc.Name, err, delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		go s.handle(conn)
+	}
+}
+
+// Close stops the server, and removes its socket. Running commands
+// are left alone, they end when their connections do.
+func (s *server) close() {
+	s.l.Close()
+	os.Remove(s.name)
+}
+
+// Shutdown closes all the servers.
+func shutdown(srvs []*server) {
+	for _, s := range srvs {
+		s.close()
+	}
+}
+
+// Streams holds the resumable streams of session clients.
+var streams resume.Server
+
+// DrainTimeout is how long to wait for the remote end to receive the
+// last output of a command in a session.
+const drainTimeout = time.Minute
+
+// SniffTimeout is how long to wait for the first bytes of a client.
+// Resumable clients send their handshake straight away; clients that
+// read first, like paste, send nothing.
+const sniffTimeout = time.Second
+
+// Sniff reads the start of the data sent on conn, until it can tell
+// whether it's the handshake of a resumable stream. It returns the
+// data read, and whether conn is a liveness probe, that is, hung up
+// without sending anything.
+func sniff(conn net.Conn) (head []byte, probe, resumable bool) {
+	head = make([]byte, len(resume.Magic))
+	n := 0
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	for n < len(head) {
+		m, err := conn.Read(head[n:])
+		n += m
+		if !strings.HasPrefix(resume.Magic, string(head[:n])) {
+			break
+		}
+		if err != nil {
+			var nerr net.Error
+			probe = n == 0 && !(errors.As(err, &nerr) && nerr.Timeout())
+			break
+		}
+	}
+	return head[:n], probe, n == len(head) && string(head) == resume.Magic
+}
+
+// Handle runs the local command of the service for conn. A resumable
+// stream outlives conn, so the command is only started for new
+// streams.
+func (s *server) handle(conn net.Conn) {
+	head, probe, resumable := sniff(conn)
+	if probe {
+		// See rundir.Clean.
+		conn.Close()
+		return
+	}
+	r := io.MultiReader(bytes.NewReader(head), conn)
+	if !resumable {
+		s.run(struct {
+			io.Reader
+			io.Writer
+		}{r, conn})
+		conn.Close()
+		return
+	}
+	c, isNew, err := streams.Accept(conn, bufio.NewReader(r))
+	if err != nil {
+		log.Printf("%s: %v", s.svc.Name, err)
+		if isNew {
+			streams.Remove(c)
+		}
+		return
+	}
+	if !isNew {
+		return
+	}
+	s.run(c)
+	c.CloseWrite()
+	c.Drain(drainTimeout)
+	streams.Remove(c)
+}
+
+// Run runs the local command on rw, unless too many are running
+// already, and logs its failure, if any.
+func (s *server) run(rw io.ReadWriter) {
+	select {
+	case s.sem <- true:
+		defer func() { <-s.sem }()
+	default:
+		log.Printf("%s: too many running, refusing connection", s.svc.Name)
+		return
+	}
+	if err := spawn(rw, s.svc); err != nil {
+		log.Printf("%s: %v", s.svc.Name, err)
+	}
+}
+
+// Spawn runs the local command of svc on rw.
+func spawn(rw io.ReadWriter, svc service.Service) error {
+	argv := svc.Command()
+	cmd := exec.Command(argv[0], argv[1:]...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = rw
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	current.started(svc.Name, cmd.Process.Pid)
+	defer current.exited(cmd.Process.Pid)
+	// Copy stdin ourselves, cmd.Wait would wait for rw to be closed.
+	go func() {
+		io.Copy(stdin, rw)
+		stdin.Close()
+	}()
+	return cmd.Wait()
+}
@@ -8,109 +8,700 @@ devdraw server. It exposes the devdraw server to remote clients by
 starting plan9-shell on the remote end and forwarding devdraw
 connections to itself.
 
+Like with ssh(1), the exit status is that of the remote command, or
+255 if the connection fails, or plan9-ssh can't set it up, for
+example because the remote end refuses to forward connections.
+
+Besides devdraw, the other services listed in PLAN9_SSH_SERVICES
+(separated by spaces) are forwarded too; see devdraw-proxy. For each,
+the local command is started for every connection made on the
+remote end. For example, with PLAN9_SSH_SERVICES="plumb snarf paste",
+remote programs can send plumb messages with plumb-proxy, and use the
+local clipboard with snarf-proxy and paste-proxy. Acme needs none of
+these for its snarf buffer, which devdraw already keeps in sync with
+the local clipboard.
+
+The sockets in the local plan9port name space named in
+PLAN9_SSH_NAMESPACE (separated by spaces, plumb by default) are
+forwarded as well, and they appear in the NAMESPACE directory of
+the remote shell, so that plumb messages sent by remote programs
+reach the local plumber. Sockets that don't exist locally, for
+example because plumber isn't running, are skipped.
+
+If PLAN9_SSH_SESSION is set, cmd runs in the persistent plan9-shell
+session of that name, which is started on first use, and to which
+later invocations reattach. The devdraw connections of programs in
+the session survive the loss of the ssh connection: plan9-ssh keeps
+the local devdraw processes running and reconnects, and the programs
+carry on once it's back. A hangup, interrupt or termination signal
+stops the reconnecting. A session needs a command, like acme.
+
+Per-host settings are read from the configuration file
+$PLAN9_SSH_CONFIG, or else $XDG_CONFIG_HOME/plan9-ssh or
+$HOME/.config/plan9-ssh. It has the syntax of ssh_config(5): Host
+blocks, matched against the host as given on the command line,
+where the first value found for a keyword wins. The keywords are:
+
+	Devdraw prog [args...]   local devdraw command, unless DEVDRAW is set
+	Services name...         services to forward, unless PLAN9_SSH_SERVICES is set
+	Namespace name...        name space entries, unless PLAN9_SSH_NAMESPACE is set
+	Shell prog               remote shell for plan9-shell to run
+	Plan9Shell path          remote plan9-shell, which is not installed
+	Command cmd [args...]    command to run if none is given
+
+Services and Namespace take none for an empty list. Arguments may be
+double-quoted; those of Command reach the remote command as they were
+split. For example:
+
+	Host devbox
+		Command acme
+		Services plumb snarf paste
+		Shell rc
+
+	Host *
+		Devdraw /usr/local/plan9/bin/devdraw
+
+Every running plan9-ssh is recorded, under the name of its session,
+or else of its host, made unique with a number. The subcommands
+manage them: ls lists them, with their host, process, start time, and
+the local commands, like devdraw, they are running for remote
+programs; kill terminates them and their local commands; attach
+reattaches to a persistent session whose plan9-ssh has exited, or
+lost its connection for good, with the original command line. A host
+called like a subcommand can be reached as user@host.
+
+Local sockets are kept in the private directory
+$XDG_RUNTIME_DIR/plan9-ssh, or $TMPDIR/plan9-ssh.uid if XDG_RUNTIME_DIR
+is not set. Stale sockets left there by crashed sessions are removed
+at start-up.
+
 This program wraps ssh(1), so $HOME/.ssh/config is honored, as well
-as any extra ssh(1) options passed on the command line.
+as any extra ssh(1) options passed on the command line. The program
+run is $PLAN9_SSH_SSH, or ssh if it's not set; anything that takes
+the same arguments will do, like a stand-in that runs the command
+locally.
+
+The remote sockets are forwarded into $HOME/.cache/plan9-ssh/run on
+the remote end, a directory accessible only by the user, which
+plan9-ssh creates with an extra connection before the first session.
+That connection also finds out the remote login shell, so that the
+command line of plan9-shell is quoted for rc and fish, if need be, as
+well as for POSIX shells.
+
+plan9-shell needn't be installed on the remote end. If it's not in
+the remote PATH, plan9-ssh uploads one built for the remote system to
+$HOME/.cache/plan9-ssh and runs that. The binary is the plan9-shell
+next to plan9-ssh if the systems match, or else one cross-compiled
+into the local cache directory, $XDG_CACHE_HOME/plan9-ssh. A released
+plan9-ssh builds plan9-shell of the same version with go install, on
+first use; a development build builds it from its own source tree
+with go build, every time. Set PLAN9_SSH_INSTALL=no to never upload
+plan9-shell.
+
+What the extra connection finds out is remembered for each host in
+the state directory, until plan9-shell changes locally, or the remote
+end loses the remembered plan9-shell, which shows as exit status 127,
+or the runtime directory, which makes the forwarding fail.
+
+If PLAN9_SSH_CLIENT is set to builtin, a built-in SSH client is used
+instead of ssh(1). It understands the basics of $HOME/.ssh/config
+(Host blocks and Include lines, with HostName, User, Port, IdentityFile,
+UserKnownHostsFile and ProxyJump) and the options -p, -l, -i, -F, -J,
+-o, -t and -T. It authenticates with the keys in ssh-agent(1) and the
+unencrypted identity files, and only connects to hosts in known_hosts.
+Jump hosts are connected to one after the other, each through the
+previous one, and the forwards are set up on the last host only.
+
+Either way, if the remote sshd(8), or one on the way, refuses to
+forward unix domain sockets, plan9-ssh fails, unless PLAN9_SSH_TCP
+lists services, separated by spaces, which are then forwarded through
+TCP ports on the remote loopback interface instead; the others are
+dropped. Beware that, unlike the unix domain sockets, which only the
+user can reach, these ports can be reached by every user of the
+remote host. Through devdraw, they can open windows on the local
+display, and read and overwrite the snarf buffer, which devdraw keeps
+in the local clipboard; through plumb, they can send plumb messages.
+The clipboard services, snarf and paste, are never forwarded that
+way, even if listed. Name space entries need unix domain sockets;
+with ssh(1) they are dropped in that case, the built-in client merely
+skips those that fail.
 */
 package main
 
 import (
+	"bytes"
 	"crypto/rand"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"log"
-	"net"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
+	"mgk.ro/cmd/plan9/internal/rundir"
+	"mgk.ro/cmd/plan9/internal/service"
 	_ "mgk.ro/log"
 )
 
-func main() {
-	local := tmpfile()
-	go serve(local)
-	network, addr := cmdsplit(os.Args[1:])
-	ssh(network, addr, local, tmpfile()) // different filename, so ssh localhost works.
-	os.Remove(local)
+// A forward is a service whose remote socket is forwarded to a local
+// one.
+type forward struct {
+	svc    service.Service
+	local  string
+	remote string // different filename, so ssh localhost works.
+}
+
+// An export is a socket from the local name space forwarded to the
+// remote end.
+type export struct {
+	name   string // file name in the name space
+	local  string
+	remote string
 }
 
-func serve(name string) {
-	l, err := net.Listen("unix", name)
+var usageString = `usage: plan9-ssh [ssh-options...] [user@]host [cmd [args...]]
+       plan9-ssh ls
+       plan9-ssh attach session
+       plan9-ssh kill session...
+`
+
+// Current records this plan9-ssh for the subcommands.
+var current *state
+
+func usage() {
+	fmt.Fprint(os.Stderr, usageString)
+	os.Exit(255)
+}
+
+// Fatal is like log.Fatal, but exits with status 255, which ssh(1)
+// uses for its own failures, so they are not mistaken for failures
+// of the remote command.
+func fatal(v ...interface{}) {
+	log.Print(v...)
+	os.Exit(255)
+}
+
+// ExitStatus returns the exit status for the outcome of run, and a
+// message to print, if any. Like ssh(1), it's the exit status of the
+// remote command, or 255 if the connection or the set-up failed.
+func exitStatus(err error) (int, string) {
+	var exiterr *exec.ExitError
+	var status exitError
+	switch {
+	case err == nil:
+		return 0, ""
+	case errors.As(err, &status):
+		return int(status), ""
+	case errors.As(err, &exiterr) && exiterr.Exited():
+		// Ssh(1) has already said what went wrong, if anything.
+		return exiterr.ExitCode(), ""
+	}
+	return 255, err.Error()
+}
+
+func main() {
+	if len(os.Args) > 1 && isSubcommand(os.Args[1]) {
+		subcommand(os.Args[1:])
+	}
+	network, addr, err := cmdsplit(os.Args[1:])
 	if err != nil {
-		log.Fatal(err)
+		log.Print(err)
+		usage()
 	}
-	for {
-		conn, err := l.Accept()
+	host := network[len(network)-1]
+	host = host[strings.LastIndex(host, "@")+1:]
+	cfg, err := readConfig(defaultConfig(), host)
+	if err != nil {
+		fatal(err)
+	}
+	if addr == "" {
+		addr = cfg.command
+	}
+	if cfg.devdraw != nil && os.Getenv("DEVDRAW") == "" {
+		os.Setenv("DEVDRAW", strings.Join(cfg.devdraw, " "))
+	}
+	session := os.Getenv("PLAN9_SSH_SESSION")
+	if session != "" && addr == "" {
+		fatal("a session needs a command")
+	}
+	dir, err := rundir.Dir("plan9-ssh")
+	if err != nil {
+		fatal(err)
+	}
+	rundir.Clean(dir)
+	svcnames := cfg.services
+	if v, ok := os.LookupEnv("PLAN9_SSH_SERVICES"); ok {
+		svcnames = strings.Fields(v)
+	}
+	fwds := forwards(dir, append([]string{"devdraw"}, svcnames...))
+	sdir, err := stateDir()
+	if err != nil {
+		fatal(err)
+	}
+	name := session
+	if name == "" {
+		name = host
+	}
+	var sockets []string
+	for _, f := range fwds {
+		sockets = append(sockets, f.local)
+	}
+	if current, err = newState(sdir, name, host, os.Args[1:], session != "", sockets); err != nil {
+		fatal(err)
+	}
+	var srvs []*server
+	for _, f := range fwds {
+		s, err := listen(f.local, f.svc)
 		if err != nil {
-			panic(err)
+			shutdown(srvs)
+			current.remove()
+			fatal(err)
+		}
+		go s.serve()
+		srvs = append(srvs, s)
+	}
+	nsnames := []string{"plumb"}
+	if cfg.namespace != nil {
+		nsnames = cfg.namespace
+	}
+	if v, ok := os.LookupEnv("PLAN9_SSH_NAMESPACE"); ok {
+		nsnames = strings.Fields(v)
+	}
+	exps := exports(nsnames)
+	run, remoteRun := ssh, sshRun
+	if os.Getenv("PLAN9_SSH_CLIENT") == "builtin" {
+		run, remoteRun = builtin, builtinRun
+	}
+	upload := cfg.plan9shell == "" && os.Getenv("PLAN9_SSH_INSTALL") != "no"
+	rec, remembered := lookupRemote(network)
+	if !remembered {
+		if rec, _, err = setup(network, remoteRun, upload); err != nil {
+			shutdown(srvs)
+			current.remove()
+			fatal(err)
+		}
+	}
+	remoteSockets(rec.Rundir, fwds, exps)
+	loginShell = rec.Login
+	shell := []string{rec.Shell}
+	if cfg.plan9shell != "" {
+		shell[0] = cfg.plan9shell
+	}
+	if cfg.shell != "" {
+		shell = append(shell, "-shell", cfg.shell)
+	}
+	exit := func(err error) {
+		shutdown(srvs)
+		current.remove()
+		status, msg := exitStatus(err)
+		if msg != "" {
+			log.Print(msg)
+		}
+		os.Exit(status)
+	}
+	// A terminating signal, as sent by kill, stops the reattaching.
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := run(network, addr, shell, session, fwds, exps)
+		if remembered {
+			// The remembered plan9-shell or runtime directory may
+			// be gone from the remote end. If so, set it up again
+			// and retry.
+			status, _ := exitStatus(err)
+			var ferr forwardError
+			refused := errors.As(err, &ferr)
+			if refused || upload && status == 127 {
+				remembered = false
+				forgetRemote(network)
+				r, uploaded, serr := setup(network, remoteRun, upload)
+				if serr == nil && (refused || uploaded || r != rec) {
+					rec = r
+					loginShell = rec.Login
+					if cfg.plan9shell == "" {
+						shell[0] = rec.Shell
+					}
+					remoteSockets(rec.Rundir, fwds, exps)
+					continue
+				}
+			}
+		}
+		if session == "" || !connectionLost(err) {
+			exit(err)
+		}
+		if time.Since(start) > time.Minute {
+			backoff = time.Second
+		}
+		log.Printf("connection lost, reattaching to session %s in %v", session, backoff)
+		select {
+		case sig := <-sigc:
+			exit(fmt.Errorf("signal: %v", sig))
+		case <-time.After(backoff):
+		}
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+		// The old remote sockets may linger on the remote end.
+		remoteSockets(rec.Rundir, fwds, exps)
+	}
+}
+
+// ConnectionLost reports whether err means that ssh(1), or the
+// built-in client, couldn't reach the remote end, or lost the
+// connection to it.
+func connectionLost(err error) bool {
+	var exiterr *exec.ExitError
+	var cerr connError
+	return errors.As(err, &exiterr) && exiterr.ExitCode() == 255 || errors.As(err, &cerr)
+}
+
+// A connError is a failure of the built-in client to reach the remote
+// end, or to keep the connection to it.
+type connError struct {
+	err error
+}
+
+func (e connError) Error() string { return e.err.Error() }
+func (e connError) Unwrap() error { return e.err }
+
+// An exitError is the non-zero exit status of the remote command, as
+// reported to the built-in client.
+type exitError int
+
+func (e exitError) Error() string { return fmt.Sprintf("exit status %d", int(e)) }
+
+// Forwards returns a forward for each of the named services, with
+// local sockets in dir.
+func forwards(dir string, names []string) []forward {
+	var fwds []forward
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		svc, ok := service.Lookup(name)
+		if !ok {
+			fatal(fmt.Sprintf("unknown service %q", name))
 		}
-		go devdraw(conn)
+		local := filepath.Join(dir, name+"-"+randname())
+		fwds = append(fwds, forward{svc: svc, local: local})
 	}
+	return fwds
 }
 
-func devdraw(conn net.Conn) {
-	exe := os.Getenv("DEVDRAW")
-	if exe == "" {
-		exe = "devdraw"
+// Exports returns an export for each of the named sockets that exist
+// in the local name space.
+func exports(names []string) []export {
+	if len(names) == 0 {
+		return nil
 	}
-	cmd := exec.Command(exe)
-	cmd.Stdin = conn
-	cmd.Stdout = conn
-	cmd.Stderr = os.Stderr
-	err := cmd.Run()
+	ns := namespace()
+	if ns == "" {
+		return nil
+	}
+	var exps []export
+	for _, name := range names {
+		local := filepath.Join(ns, name)
+		fi, err := os.Stat(local)
+		if err != nil || fi.Mode()&os.ModeSocket == 0 {
+			continue
+		}
+		exps = append(exps, export{name: name, local: local})
+	}
+	return exps
+}
+
+// Namespace returns the local plan9port name space directory, or ""
+// if it can't be determined.
+func namespace() string {
+	if ns := os.Getenv("NAMESPACE"); ns != "" {
+		return ns
+	}
+	out, err := exec.Command("namespace").Output()
 	if err != nil {
-		panic(err)
+		return ""
 	}
-	conn.Close()
+	return strings.TrimSpace(string(out))
 }
 
-func ssh(args []string, command string, local, remote string) {
-	cmd := exec.Command("ssh", args...)
-	cmd.Args = append(cmd.Args,
-		"-R", fmt.Sprintf("%s:%s", remote, local),
-		"-o", "ExitOnForwardFailure=yes",
-		"plan9-shell",
-		"-addr", fmt.Sprintf("unix!%s", remote),
-	)
-	if command != "" {
-		cmd.Args = append(cmd.Args, "-c", command)
-	} else {
+// SshProg returns the ssh(1) program to run, $PLAN9_SSH_SSH or ssh.
+func sshProg() string {
+	if prog := os.Getenv("PLAN9_SSH_SSH"); prog != "" {
+		return prog
+	}
+	return "ssh"
+}
+
+// Ssh runs plan9-shell on the remote end with ssh(1). If the remote
+// end, or a jump host on the way, refuses to forward unix domain
+// sockets, and tcpFallback allows it, ssh(1) is run again with the
+// services tcpAllowed allows forwarded through TCP ports on the remote
+// loopback interface. Name space entries can't be forwarded that way,
+// so they are dropped.
+func ssh(args []string, command string, shell []string, session string, fwds []forward, exps []export) error {
+	err := runSSH(args, command, shell, session, fwds, exps, false)
+	var ferr forwardError
+	if errors.As(err, &ferr) && tcpFallback() {
+		log.Print("unix domain socket forwarding failed, using TCP ports")
+		// The random ports may be taken on the remote end, which
+		// fails the forwarding too, so try a few times.
+		for i := 0; i < tcpTries; i++ {
+			err = runSSH(args, command, shell, session, tcpForwards(fwds), nil, true)
+			if !errors.As(err, &ferr) {
+				break
+			}
+		}
+	}
+	return err
+}
+
+// TcpTries is how many times ssh tries forwarding through random TCP
+// ports.
+const tcpTries = 3
+
+// TcpFallback reports whether any services may be forwarded through
+// TCP ports on the remote end when unix domain sockets can't be, which
+// PLAN9_SSH_TCP allows.
+func tcpFallback() bool {
+	return len(strings.Fields(os.Getenv("PLAN9_SSH_TCP"))) > 0
+}
+
+// TcpAllowed reports whether svc may be forwarded through a TCP port,
+// which every user of the remote host can connect to: it must be
+// listed in PLAN9_SSH_TCP, and not be private.
+func tcpAllowed(svc service.Service) bool {
+	if svc.Private {
+		return false
+	}
+	for _, name := range strings.Fields(os.Getenv("PLAN9_SSH_TCP")) {
+		if name == svc.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// TcpForwards returns the forwards that may go through TCP ports.
+func tcpForwards(fwds []forward) []forward {
+	var tcp []forward
+	for _, f := range fwds {
+		if !tcpAllowed(f.svc) {
+			log.Printf("not forwarding %s through a TCP port", f.svc.Name)
+			continue
+		}
+		tcp = append(tcp, f)
+	}
+	return tcp
+}
+
+// A forwardError is the failure to set up a remote forward, which
+// reconnecting won't fix.
+type forwardError struct {
+	err error // details, if any
+}
+
+func (e forwardError) Error() string {
+	msg := "the remote end refused to forward connections to plan9-ssh; see AllowStreamLocalForwarding and AllowTcpForwarding in sshd_config(5), and PLAN9_SSH_TCP in plan9-ssh(1)"
+	if e.err != nil {
+		msg += ": " + e.err.Error()
+	}
+	return msg
+}
+
+func (e forwardError) Unwrap() error { return e.err }
+
+// RunSSH runs ssh(1) once, forwarding through unix domain sockets, or
+// TCP ports if tcp is true.
+func runSSH(args []string, command string, shell []string, session string, fwds []forward, exps []export, tcp bool) error {
+	cmd := exec.Command(sshProg(), args...)
+	var addrs []string
+	for _, f := range fwds {
+		if tcp {
+			port := randport()
+			cmd.Args = append(cmd.Args, "-R", fmt.Sprintf("127.0.0.1:%d:%s", port, f.local))
+			addrs = append(addrs, fmt.Sprintf("tcp!127.0.0.1!%d", port))
+			continue
+		}
+		cmd.Args = append(cmd.Args, "-R", fmt.Sprintf("%s:%s", f.remote, f.local))
+		addrs = append(addrs, fmt.Sprintf("unix!%s", f.remote))
+	}
+	for _, e := range exps {
+		cmd.Args = append(cmd.Args, "-R", fmt.Sprintf("%s:%s", e.remote, e.local))
+	}
+	cmd.Args = append(cmd.Args, "-o", "ExitOnForwardFailure=yes")
+	cmd.Args = append(cmd.Args, shellCommand(shell, command, session, fwds, addrs, exps)...)
+	if command == "" {
 		pre := []string{cmd.Args[0], "-t"}
 		cmd.Args = append(pre, cmd.Args[1:]...)
 	}
 	cmd.Stdin = os.Stdin
+	if session != "" {
+		// The remote end of a session takes the end of its input
+		// to mean the connection is gone, so never send it.
+		r, w, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		defer w.Close()
+		cmd.Stdin = r
+	}
 	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		log.Fatal(err)
+	stderr := &forwardWatcher{w: os.Stderr}
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// Don't die before ssh(1) does, so we can clean up after it.
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigc)
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	var killed os.Signal
+	for {
+		select {
+		case sig := <-sigc:
+			cmd.Process.Signal(sig)
+			killed = sig
+		case err := <-done:
+			switch {
+			case err != nil && stderr.failed:
+				// Ssh(1) has printed the details.
+				return forwardError{}
+			case err != nil && killed != nil:
+				// Ssh(1) exits with 255 when signaled, which
+				// must not be taken for a lost connection.
+				return fmt.Errorf("signal: %v", killed)
+			}
+			return err
+		}
+	}
+}
+
+// A forwardWatcher passes the standard error of ssh(1) through, and
+// notes whether it reports a failed remote forward.
+type forwardWatcher struct {
+	w      io.Writer
+	buf    []byte // tail of the output, for messages split across writes
+	failed bool
+}
+
+func (fw *forwardWatcher) Write(p []byte) (int, error) {
+	const msg = "remote port forwarding failed"
+	fw.buf = append(fw.buf, p...)
+	if bytes.Contains(fw.buf, []byte(msg)) {
+		fw.failed = true
+	}
+	if len(fw.buf) > len(msg) {
+		fw.buf = append(fw.buf[:0], fw.buf[len(fw.buf)-len(msg):]...)
 	}
+	return fw.w.Write(p)
 }
 
-// cmdsplit splits the ssh args by isolating the command (if any).
-func cmdsplit(args []string) (params []string, cmd string) {
-	lastNonFlag := -1
-	dash := false
-	for k, v := range args {
-		if strings.HasPrefix(v, "-") {
-			dash = true
+// ShellCommand returns the command line that runs plan9-shell on the
+// remote end, quoted for the remote shell. Shell is its name, followed
+// by any extra options. The remote ends of fwds are at addrs.
+func shellCommand(shell []string, command, session string, fwds []forward, addrs []string, exps []export) []string {
+	args := append([]string(nil), shell...)
+	for i, f := range fwds {
+		if f.svc.Name == "devdraw" {
+			args = append(args, "-addr", addrs[i])
 		} else {
-			if lastNonFlag != k-1 {
-				return args[:k+1], strings.Join(args[k+1:], " ")
-			}
-			lastNonFlag = k
+			args = append(args, "-s", fmt.Sprintf("%s=%s", f.svc.Name, addrs[i]))
 		}
 	}
-	if !dash {
-		return []string{args[0]}, strings.Join(args[1:], " ")
+	for _, e := range exps {
+		args = append(args, "-n", fmt.Sprintf("%s=%s", e.name, e.remote))
+	}
+	if session != "" {
+		args = append(args, "-S", session)
+	}
+	if command != "" {
+		args = append(args, "-c", command)
+	}
+	for i, a := range args {
+		args[i] = quote(a)
+	}
+	return args
+}
+
+// LoginShell is the name of the remote login shell, which quote quotes
+// for, once known.
+var loginShell string
+
+// Quote quotes s for the remote login shell, if needed. Like ssh(1),
+// the remote end gets the command as a string, for that shell to
+// split.
+func quote(s string) string {
+	return shellQuote(loginShell, s)
+}
+
+// ShellQuote quotes s for the shell named sh, if needed. Plan 9 rc and
+// fish take single quotes like POSIX shells do, but escape the single
+// quotes in them differently, and have more special characters.
+func shellQuote(sh, s string) string {
+	safe := "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_@%+=:,./!-"
+	if sh == "rc" || sh == "fish" {
+		safe = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_@+:,./-"
+	}
+	if s != "" && strings.Trim(s, safe) == "" {
+		return s
+	}
+	switch sh {
+	case "rc":
+		return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+	case "fish":
+		return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// RemoteSockets gives the remote ends of fwds and exps new names in
+// the remote runtime directory dir.
+func remoteSockets(dir string, fwds []forward, exps []export) {
+	for i := range fwds {
+		fwds[i].remote = remoteSocket(dir)
+	}
+	for i := range exps {
+		exps[i].remote = remoteSocket(dir)
+	}
+}
+
+// RemoteSocket returns a name for a remote socket in dir. The remote
+// runtime directory is accessible only by the user, so the name need
+// only be unique.
+func remoteSocket(dir string) string {
+	return dir + "/plan9-" + randname()[:16]
+}
+
+// Randport returns a random unprivileged TCP port number.
+func randport() int {
+	b := make([]byte, 2)
+	_, err := rand.Read(b)
+	if err != nil {
+		fatal("can't generate random port")
 	}
-	return args, ""
+	return 20000 + int(binary.BigEndian.Uint16(b))%40000
 }
 
-func tmpfile() string {
+func randname() string {
 	b := make([]byte, 16)
 	_, err := rand.Read(b)
 	if err != nil {
-		log.Fatal("can't generate random filename")
+		fatal("can't generate random filename")
 	}
-	return "/tmp/devdraw-" + hex.EncodeToString(b)
+	return hex.EncodeToString(b)
 }
@@ -0,0 +1,94 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestRunSSHSignal checks that ssh(1) exiting with 255 because it was
+// sent a signal is not taken for a lost connection.
+func TestRunSSHSignal(t *testing.T) {
+	dir := t.TempDir()
+	ready := filepath.Join(dir, "ready")
+	ssh := filepath.Join(dir, "ssh")
+	script := "#!/bin/sh\ntrap 'exit 255' TERM\n: >" + ready + "\nwhile :; do sleep 0.05; done\n"
+	if err := os.WriteFile(ssh, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PLAN9_SSH_SSH", ssh)
+
+	// Keep the signal from killing the test if runSSH isn't
+	// watching yet.
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM)
+	defer signal.Stop(c)
+	go func() {
+		for {
+			if _, err := os.Stat(ready); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	}()
+	err := runSSH([]string{"host"}, "acme", []string{"plan9-shell"}, "s", nil, nil, false)
+	if err == nil {
+		t.Fatal("runSSH succeeded")
+	}
+	if connectionLost(err) {
+		t.Errorf("runSSH: %v taken for a lost connection", err)
+	}
+	if status, msg := exitStatus(err); status != 255 || msg != "signal: terminated" {
+		t.Errorf("exitStatus(%v) = %d, %q; want 255, %q", err, status, msg, "signal: terminated")
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct {
+		sh, s, want string
+	}{
+		{"sh", "plan9-shell", "plan9-shell"},
+		{"sh", "snarf=unix!/tmp/x", "snarf=unix!/tmp/x"},
+		{"sh", "", "''"},
+		{"sh", "acme -l", "'acme -l'"},
+		{"sh", "it's", `'it'\''s'`},
+		{"bash", "$HOME", "'$HOME'"},
+		{"rc", "snarf=unix!/tmp/x", "'snarf=unix!/tmp/x'"},
+		{"rc", "it's", "'it''s'"},
+		{"rc", "/tmp/x", "/tmp/x"},
+		{"fish", "it's a \\", `'it\'s a \\'`},
+		{"fish", "%self", "'%self'"},
+	}
+	for _, tt := range tests {
+		if got := shellQuote(tt.sh, tt.s); got != tt.want {
+			t.Errorf("shellQuote(%q, %q) = %s, want %s", tt.sh, tt.s, got, tt.want)
+		}
+	}
+
+	// The shells at hand get the words back.
+	words := []string{"plain", "", "two words", "it's", `back\slash`, "$HOME", "a=b", "unix!/x", "%self", "*?[{}]#;&|^<>()`\""}
+	for _, sh := range []string{"sh", "bash", "dash", "rc", "fish"} {
+		path, err := exec.LookPath(sh)
+		if err != nil {
+			continue
+		}
+		for _, w := range words {
+			cmd := "printf " + shellQuote(sh, "%s") + " " + shellQuote(sh, w)
+			out, err := exec.Command(path, "-c", cmd).Output()
+			if err != nil {
+				t.Errorf("%s -c %s: %v", sh, cmd, err)
+				continue
+			}
+			if got := string(out); got != w {
+				t.Errorf("%s -c %s printed %q, want %q", sh, cmd, got, w)
+			}
+		}
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"mgk.ro/cmd/plan9/internal/rundir"
+)
+
+// A state records a running plan9-ssh, for the ls, attach and kill
+// subcommands. It's kept in name.json in the state directory, next to
+// name.lock, which the running plan9-ssh holds locked.
+type state struct {
+	Name    string
+	Host    string
+	Args    []string // command line, without the program name
+	Session bool     // a persistent remote session, see PLAN9_SSH_SESSION
+	PID     int
+	Start   time.Time
+	Sockets []string // local sockets
+	Procs   []proc   // running local commands
+
+	live bool // read from the state directory, and still running
+
+	mu   sync.Mutex
+	file string
+	lock *os.File
+}
+
+// A proc is a local command started for a forwarded connection.
+type proc struct {
+	Service string
+	PID     int
+}
+
+// StateDir returns the state directory, creating it if needed.
+func stateDir() (string, error) {
+	dir, err := rundir.Dir("plan9-ssh")
+	if err != nil {
+		return "", err
+	}
+	dir = filepath.Join(dir, "state")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// NewState records the running plan9-ssh in dir. If session is true,
+// the state is named name, otherwise it gets the first free name of
+// name, name-2, name-3, and so on.
+func newState(dir, name, host string, args []string, session bool, sockets []string) (*state, error) {
+	s := &state{
+		Host:    host,
+		Args:    args,
+		Session: session,
+		PID:     os.Getpid(),
+		Start:   time.Now(),
+		Sockets: sockets,
+	}
+	for n := 1; ; n++ {
+		s.Name = name
+		if n > 1 {
+			s.Name = fmt.Sprintf("%s-%d", name, n)
+		}
+		if strings.Contains(s.Name, "/") {
+			return nil, fmt.Errorf("invalid session name %q", s.Name)
+		}
+		lock, err := os.OpenFile(filepath.Join(dir, s.Name+".lock"), os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		if tryLock(lock, true) != nil {
+			lock.Close()
+			if session {
+				return nil, fmt.Errorf("session %s is already attached", s.Name)
+			}
+			continue
+		}
+		s.file = filepath.Join(dir, s.Name+".json")
+		if !session {
+			// Don't take over the record of a detached session.
+			if old, err := readState(s.file); err == nil && old.Session {
+				lock.Close()
+				continue
+			}
+		}
+		s.lock = lock
+		return s, s.save()
+	}
+}
+
+// Save writes the state file.
+func (s *state) save() error {
+	b, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := s.file + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.file)
+}
+
+// Started records that the local command of svc is running as pid.
+func (s *state) started(svc string, pid int) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Procs = append(s.Procs, proc{svc, pid})
+	s.save()
+}
+
+// Exited records that the local command pid is gone.
+func (s *state) exited(pid int) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, p := range s.Procs {
+		if p.PID == pid {
+			s.Procs = append(s.Procs[:i], s.Procs[i+1:]...)
+			break
+		}
+	}
+	s.save()
+}
+
+// Remove deletes the record of a plan9-ssh that ends. The record of a
+// persistent session is kept, so that it can be attached later.
+func (s *state) remove() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Session {
+		s.Procs = nil
+		s.save()
+	} else {
+		os.Remove(s.file)
+		os.Remove(filepath.Join(filepath.Dir(s.file), s.Name+".lock"))
+	}
+	s.lock.Close()
+}
+
+// ReadState reads the state file name.
+func readState(name string) (*state, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	s := new(state)
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	s.file = name
+	return s, nil
+}
+
+// ReadStates returns the states recorded in dir, sorted by name. The
+// records of plan9-ssh processes that died are removed, except for
+// persistent sessions, which are merely detached.
+func readStates(dir string) ([]*state, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var states []*state
+	for _, name := range names {
+		s, err := readState(name)
+		if err != nil {
+			continue
+		}
+		s.live = locked(filepath.Join(dir, s.Name+".lock"))
+		if !s.live {
+			if !s.Session {
+				os.Remove(name)
+				os.Remove(filepath.Join(dir, s.Name+".lock"))
+				continue
+			}
+			s.Procs = nil
+		}
+		states = append(states, s)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Name < states[j].Name })
+	return states, nil
+}
+
+// Locked reports whether someone holds the lock file name.
+func locked(name string) bool {
+	f, err := os.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	return tryLock(f, false) != nil
+}
+
+// LookupState returns the state named name.
+func lookupState(name string) (*state, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return nil, err
+	}
+	states, err := readStates(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range states {
+		if s.Name == name {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("no session %s", name)
+}
+
+// Subcommand runs the ls, attach or kill subcommand, and exits.
+func subcommand(args []string) {
+	switch args[0] {
+	case "ls":
+		if len(args) != 1 {
+			usage()
+		}
+		if err := list(); err != nil {
+			log.Fatal(err)
+		}
+	case "attach":
+		if len(args) != 2 {
+			usage()
+		}
+		if err := attach(args[1]); err != nil {
+			log.Fatal(err)
+		}
+	case "kill":
+		if len(args) < 2 {
+			usage()
+		}
+		status := 0
+		for _, name := range args[1:] {
+			if err := kill(name); err != nil {
+				log.Print(err)
+				status = 1
+			}
+		}
+		os.Exit(status)
+	}
+	os.Exit(0)
+}
+
+// List prints the sessions.
+func list() error {
+	dir, err := stateDir()
+	if err != nil {
+		return err
+	}
+	states, err := readStates(dir)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSTATUS\tHOST\tPID\tSTARTED\tPROCS")
+	for _, s := range states {
+		status, pid := "running", fmt.Sprint(s.PID)
+		if !s.live {
+			status, pid = "detached", "-"
+		}
+		var procs []string
+		for _, p := range s.Procs {
+			procs = append(procs, fmt.Sprintf("%s:%d", p.Service, p.PID))
+		}
+		if len(procs) == 0 {
+			procs = []string{"-"}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", s.Name, status, s.Host, pid,
+			s.Start.Format("Jan _2 15:04"), strings.Join(procs, ","))
+	}
+	return w.Flush()
+}
+
+// Attach reattaches to the detached persistent session name, by
+// running plan9-ssh again like it was run first.
+func attach(name string) error {
+	s, err := lookupState(name)
+	if err != nil {
+		return err
+	}
+	if s.live {
+		return fmt.Errorf("session %s is already attached", name)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	env := append(os.Environ(), "PLAN9_SSH_SESSION="+s.Name)
+	return syscall.Exec(exe, append([]string{"plan9-ssh"}, s.Args...), env)
+}
+
+// Kill terminates session name, and the local commands it started,
+// and forgets it. Killing a detached session merely forgets it; the
+// programs on the remote end run until they exit.
+func kill(name string) error {
+	s, err := lookupState(name)
+	if err != nil {
+		return err
+	}
+	lock := filepath.Join(filepath.Dir(s.file), s.Name+".lock")
+	if s.live {
+		for _, p := range s.Procs {
+			terminate(p.PID)
+		}
+		err := terminate(s.PID)
+		if err != nil && !errors.Is(err, syscall.ESRCH) {
+			return fmt.Errorf("session %s: %v", name, err)
+		}
+		// Wait for it to go, it records a session as detached.
+		for i := 0; locked(lock); i++ {
+			if i == 100 {
+				return fmt.Errorf("session %s: still running", name)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	os.Remove(s.file)
+	os.Remove(lock)
+	return nil
+}
+
+// IsSubcommand reports whether arg names a subcommand. A host with
+// such a name can still be reached as user@host.
+func isSubcommand(arg string) bool {
+	switch arg {
+	case "ls", "attach", "kill":
+		return true
+	}
+	return false
+}
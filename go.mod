@@ -1,3 +1,9 @@
 module mgk.ro
 
 go 1.18
+
+require (
+	golang.org/x/crypto v0.23.0
+	golang.org/x/sys v0.20.0
+	golang.org/x/term v0.20.0
+)